@@ -1,26 +1,351 @@
 package main
 
 import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/golang-lru/v2/expirable"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/chenjiandongx/dnstrack/codec"
+	"github.com/chenjiandongx/dnstrack/formatter"
 )
 
+// txKey identifies the dns transactions, the client is the sender of the query
+// and the server is the receiver whichever ports they use.
+type txKey struct {
+	device    string
+	transport string
+	client    netip.AddrPort
+	server    netip.AddrPort
+	id        uint16
+}
+
+// txQuestion is the first question of the message, it's zero if there are no
+// questions which is allowed in some responses.
+type txQuestion struct {
+	name  dnsmessage.Name
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+// parseQuestion parses the first question without the allocations of decoding
+// the whole message.
+func parseQuestion(payload []byte) txQuestion {
+	var p dnsmessage.Parser
+	if _, err := p.Start(payload); err != nil {
+		return txQuestion{}
+	}
+	q, err := p.Question()
+	if err != nil {
+		return txQuestion{}
+	}
+	return txQuestion{name: q.Name, typ: q.Type, class: q.Class}
+}
+
+// retryMinInterval is how long an attempt is unanswered at least before the
+// same question asked with another socket or ID is taken as its retransmission,
+// otherwise they're the queries of their own, e.g. the processes looking up the
+// same name at the same time.
+const retryMinInterval = time.Second
+
+// retryKey identifies the retransmissions of a query, the stub resolvers may
+// retry with the same socket and ID or the new ones.
+type retryKey struct {
+	device    string
+	transport string
+	client    netip.Addr
+	server    netip.AddrPort
+	question  txQuestion
+}
+
+// retryGroup is the attempts of a query retransmitted with the new sockets or
+// IDs, they're all pending since any of them may be answered.
+type retryGroup struct {
+	elems    []*list.Element
+	first    time.Time
+	attempts int
+}
+
+// entry is the in-flight query waiting for its response, the raw frames are
+// only kept when the matched transactions are written to file.
+type entry struct {
+	// when is the time of the latest attempt and first is the one of the first
+	// attempt
+	when     time.Time
+	first    time.Time
+	attempts int
+	device   string
+	txid     uint64
+	size     int
+	question txQuestion
+	msg      *codec.Message
+	server   string
+	vlans    []uint16
+	frames   []capturedFrame
+	process  *formatter.Process
+
+	// res and hop are the resolution correlated with if enabled
+	res *resolution
+	hop *hop
+}
+
+// pending is the query queued in the order of arrival.
+type pending struct {
+	key txKey
+	entry
+	group *retryGroup
+
+	// timer is the element of the query waiting for the timeout, it's nil once
+	// the timeout is reported
+	timer *list.Element
+}
+
+// cache holds the in-flight queries, the ones sharing the key are told apart by
+// the questions. The queries are kept in the order of the latest attempts so that
+// the oldest ones are evicted once it's full and expired first, the ones yet to
+// time out are kept in the same order as well.
 type cache struct {
-	m *expirable.LRU[string, time.Time]
+	mu      sync.Mutex
+	size    int
+	entries map[txKey][]*list.Element
+	retries map[retryKey]*list.Element
+	order   *list.List
+	timers  *list.List
+	// retried is the number of the attempts pending besides the first ones
+	retried int
+
+	evictions   atomic.Int64
+	expirations atomic.Int64
 }
 
-func newCache() *cache {
+func newCache(size int) *cache {
 	return &cache{
-		m: expirable.NewLRU[string, time.Time](65535, nil, 0),
+		size:    size,
+		entries: make(map[txKey][]*list.Element),
+		retries: make(map[retryKey]*list.Element),
+		order:   list.New(),
+		timers:  list.New(),
 	}
 }
 
-func (c *cache) get(k string) (time.Time, bool) {
-	v, ok := c.m.Get(k)
-	return v, ok
+// add adds the query, it reports retransmitted if the same question is pending
+// on the same server from the same client for retryMinInterval at least. The
+// retransmission with the same socket and ID is merged into the pending one,
+// otherwise it's pending along with the earlier attempts counting the attempts
+// from the first. The txid of the pending entry is returned, it's the one of the
+// entry merged into if merged. The entries dropped are returned, including the
+// merged one and the oldest one evicted once full.
+func (c *cache) add(k txKey, e entry) (txid uint64, retransmitted bool, dropped []entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.first, e.attempts = e.when, 1
+	rk := retryKey{device: k.device, transport: k.transport, client: k.client.Addr(), server: k.server, question: e.question}
+	// prev is the latest earlier attempt if it's a retransmission
+	var prev *pending
+	var prevElem *list.Element
+	if elem, ok := c.retries[rk]; ok {
+		p := elem.Value.(*pending)
+		switch {
+		case p.key == k:
+			p.when = e.when
+			p.attempts++
+			if p.group != nil {
+				p.group.attempts++
+			}
+			c.order.MoveToBack(elem)
+			// the retransmission waits for the timeout again
+			if p.timer != nil {
+				c.timers.MoveToBack(p.timer)
+			} else {
+				p.timer = c.timers.PushBack(p)
+			}
+			return p.txid, true, []entry{e}
+
+		case e.when.Sub(p.when) >= retryMinInterval:
+			prev, prevElem = p, elem
+			retransmitted = true
+		}
+	}
+
+	if c.order.Len() >= c.size {
+		evicted, last := c.remove(c.order.Front())
+		dropped = append(dropped, evicted.entry)
+		// the query goes on with the retransmission if its last attempt is
+		// evicted
+		if evicted == prev {
+			prevElem = nil
+		} else if last {
+			c.evictions.Add(1)
+		}
+	}
+
+	var group *retryGroup
+	if prev != nil {
+		group = prev.group
+		if group == nil {
+			group = &retryGroup{first: prev.first, attempts: prev.attempts}
+			if prevElem != nil {
+				group.elems = []*list.Element{prevElem}
+			}
+			prev.group = group
+		}
+		group.attempts++
+		e.first, e.attempts = group.first, group.attempts
+	}
+	p := &pending{key: k, entry: e, group: group}
+	p.timer = c.timers.PushBack(p)
+	elem := c.order.PushBack(p)
+	if group != nil {
+		if len(group.elems) > 0 {
+			c.retried++
+		}
+		group.elems = append(group.elems, elem)
+	}
+	c.entries[k] = append(c.entries[k], elem)
+	c.retries[rk] = elem
+	return e.txid, retransmitted, dropped
+}
+
+// take removes the query answered by the response with the question along with
+// the other attempts which are returned as dropped, it reports mismatched if
+// there are queries pending on the key but none of them asks the question.
+func (c *cache) take(k txKey, q txQuestion) (e entry, dropped []entry, ok, mismatched bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elems := c.entries[k]
+	if len(elems) == 0 {
+		return entry{}, nil, false, false
+	}
+	for _, elem := range elems {
+		p := elem.Value.(*pending)
+		// the responses without questions are taken as answering the only query
+		if p.question == q || (q == txQuestion{} && len(elems) == 1) {
+			if g := p.group; g != nil {
+				p.first, p.attempts = g.first, g.attempts
+				for _, other := range append([]*list.Element(nil), g.elems...) {
+					if other != elem {
+						o, _ := c.remove(other)
+						dropped = append(dropped, o.entry)
+					}
+				}
+			}
+			c.remove(elem)
+			return p.entry, dropped, true, false
+		}
+	}
+	return entry{}, nil, false, true
+}
+
+// timeout returns the queries whose latest attempts are unanswered for the
+// timeout or longer, each of them is returned once but kept until expired so
+// that the late responses still match. The attempts retransmitted already are
+// returned as superseded instead.
+func (c *cache) timeout(now time.Time, timeout time.Duration) (timeouts []pending, superseded []entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.timers.Front(); elem != nil; elem = c.timers.Front() {
+		p := elem.Value.(*pending)
+		if now.Sub(p.when) < timeout {
+			break
+		}
+		c.timers.Remove(elem)
+		p.timer = nil
+
+		g := p.group
+		if g == nil {
+			timeouts = append(timeouts, *p)
+			continue
+		}
+		if g.elems[len(g.elems)-1].Value.(*pending) != p {
+			superseded = append(superseded, p.entry)
+			continue
+		}
+		t := *p
+		t.first, t.attempts = g.first, g.attempts
+		timeouts = append(timeouts, t)
+	}
+	return timeouts, superseded
+}
+
+// expire removes the queries whose latest attempts are lifetime or longer
+// before now.
+func (c *cache) expire(now time.Time, lifetime time.Duration) []*pending {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expired []*pending
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		p := elem.Value.(*pending)
+		if now.Sub(p.when) < lifetime {
+			break
+		}
+		// the query is expired once all the attempts are
+		if _, last := c.remove(elem); last {
+			c.expirations.Add(1)
+		}
+		expired = append(expired, p)
+	}
+	return expired
 }
 
-func (c *cache) set(k string, v time.Time) {
-	c.m.Add(k, v)
+// len returns the number of the queries pending, the attempts of a query are
+// counted once.
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len() - c.retried
+}
+
+// remove removes the attempt, it reports last if no other attempts of the query
+// are pending.
+func (c *cache) remove(elem *list.Element) (p *pending, last bool) {
+	p = elem.Value.(*pending)
+	k := p.key
+	c.order.Remove(elem)
+	if p.timer != nil {
+		c.timers.Remove(p.timer)
+		p.timer = nil
+	}
+
+	rk := retryKey{device: k.device, transport: k.transport, client: k.client.Addr(), server: k.server, question: p.question}
+	last = true
+	if g := p.group; g != nil {
+		for i := range g.elems {
+			if g.elems[i] == elem {
+				g.elems = append(g.elems[:i], g.elems[i+1:]...)
+				break
+			}
+		}
+		if len(g.elems) > 0 {
+			c.retried--
+			last = false
+		}
+	}
+	if c.retries[rk] == elem {
+		delete(c.retries, rk)
+		if !last {
+			c.retries[rk] = p.group.elems[len(p.group.elems)-1]
+		}
+	}
+
+	elems := c.entries[k]
+	for i := range elems {
+		if elems[i] == elem {
+			elems = append(elems[:i], elems[i+1:]...)
+			break
+		}
+	}
+	if len(elems) == 0 {
+		delete(c.entries, k)
+		return p, last
+	}
+	c.entries[k] = elems
+	return p, last
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testKey(client string, id uint16) txKey {
+	return txKey{
+		transport: "udp",
+		client:    netip.MustParseAddrPort(client),
+		server:    netip.MustParseAddrPort("10.0.0.53:53"),
+		id:        id,
+	}
+}
+
+func testQuestion(name string) txQuestion {
+	return txQuestion{name: dnsmessage.MustNewName(name), typ: dnsmessage.TypeA, class: dnsmessage.ClassINET}
+}
+
+func TestCacheRetransmission(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	q := testQuestion("example.com.")
+
+	tests := []struct {
+		name string
+		// the queries asking the same question are sent at the offsets
+		queries []txKey
+		after   []time.Duration
+		// retransmitted is what add reports for each query
+		retransmitted []bool
+		// answered is the query answered and attempts is the attempts taken
+		answered int
+		attempts int
+		// pending is the number of the queries left
+		pending int
+		// size is the capacity of the cache, 16 if zero
+		size      int
+		evictions int64
+	}{
+		{
+			name:          "same socket and id",
+			queries:       []txKey{testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:1000", 1)},
+			after:         []time.Duration{0, 100 * time.Millisecond},
+			retransmitted: []bool{false, true},
+			answered:      1,
+			attempts:      2,
+			pending:       0,
+		},
+		{
+			name:          "new socket answered by the first attempt",
+			queries:       []txKey{testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:2000", 2)},
+			after:         []time.Duration{0, 5 * time.Second},
+			retransmitted: []bool{false, true},
+			answered:      0,
+			attempts:      2,
+			pending:       0,
+		},
+		{
+			name:          "new socket answered by the retransmission",
+			queries:       []txKey{testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:2000", 2), testKey("10.0.0.1:3000", 3)},
+			after:         []time.Duration{0, time.Second, 2 * time.Second},
+			retransmitted: []bool{false, true, true},
+			answered:      1,
+			attempts:      3,
+			pending:       0,
+		},
+		{
+			name:          "other processes at the same time",
+			queries:       []txKey{testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:2000", 2)},
+			after:         []time.Duration{0, 10 * time.Millisecond},
+			retransmitted: []bool{false, false},
+			answered:      0,
+			attempts:      1,
+			pending:       1,
+		},
+		{
+			name:          "full cache evicting the first attempt",
+			size:          1,
+			queries:       []txKey{testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:2000", 2)},
+			after:         []time.Duration{0, 2 * time.Second},
+			retransmitted: []bool{false, true},
+			answered:      1,
+			attempts:      2,
+			pending:       0,
+		},
+		{
+			name:          "full cache evicting another query",
+			size:          2,
+			queries:       []txKey{testKey("10.0.0.2:1000", 1), testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:2000", 2)},
+			after:         []time.Duration{0, 0, 2 * time.Second},
+			retransmitted: []bool{false, false, true},
+			answered:      1,
+			attempts:      2,
+			pending:       0,
+			evictions:     1,
+		},
+		{
+			name:          "other clients",
+			queries:       []txKey{testKey("10.0.0.1:1000", 1), testKey("10.0.0.2:1000", 1)},
+			after:         []time.Duration{0, 5 * time.Second},
+			retransmitted: []bool{false, false},
+			answered:      1,
+			attempts:      1,
+			pending:       1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = 16
+			}
+			c := newCache(size)
+			for i, k := range tt.queries {
+				_, retransmitted, _ := c.add(k, entry{when: start.Add(tt.after[i]), question: q})
+				if retransmitted != tt.retransmitted[i] {
+					t.Fatalf("query %d: retransmitted = %v, want %v", i, retransmitted, tt.retransmitted[i])
+				}
+			}
+
+			e, _, ok, mismatched := c.take(tt.queries[tt.answered], q)
+			if !ok || mismatched {
+				t.Fatalf("take = %v, mismatched %v", ok, mismatched)
+			}
+			if e.attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", e.attempts, tt.attempts)
+			}
+			if tt.attempts > 1 && !e.first.Equal(start) {
+				t.Errorf("first = %s, want %s", e.first, start)
+			}
+			if n := c.len(); n != tt.pending {
+				t.Errorf("pending = %d, want %d", n, tt.pending)
+			}
+			if n := c.evictions.Load(); n != tt.evictions {
+				t.Errorf("evictions = %d, want %d", n, tt.evictions)
+			}
+		})
+	}
+}
+
+func TestCacheMergedTxid(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	q := testQuestion("example.com.")
+	c := newCache(16)
+	k := testKey("10.0.0.1:1000", 1)
+
+	if txid, _, _ := c.add(k, entry{when: start, question: q, txid: 1}); txid != 1 {
+		t.Fatalf("txid = %d, want 1", txid)
+	}
+	// the retransmission is merged into the pending query keeping its txid
+	if txid, _, _ := c.add(k, entry{when: start.Add(time.Second), question: q, txid: 2}); txid != 1 {
+		t.Fatalf("txid = %d, want 1", txid)
+	}
+	if e, _, _, _ := c.take(k, q); e.txid != 1 {
+		t.Fatalf("txid = %d, want 1", e.txid)
+	}
+}
+
+func TestCacheMismatched(t *testing.T) {
+	c := newCache(16)
+	k := testKey("10.0.0.1:1000", 1)
+	c.add(k, entry{when: time.Unix(1700000000, 0), question: testQuestion("example.com.")})
+
+	if _, _, ok, mismatched := c.take(k, testQuestion("example.org.")); ok || !mismatched {
+		t.Fatalf("take = %v, mismatched %v, want mismatched", ok, mismatched)
+	}
+	if _, _, ok, mismatched := c.take(testKey("10.0.0.1:1000", 2), testQuestion("example.com.")); ok || mismatched {
+		t.Fatalf("take = %v, mismatched %v, want neither", ok, mismatched)
+	}
+	if _, _, ok, _ := c.take(k, testQuestion("example.com.")); !ok {
+		t.Fatal("take = false, want the query")
+	}
+}
+
+func TestCacheTimeout(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	q := testQuestion("example.com.")
+	c := newCache(16)
+	first, retry := testKey("10.0.0.1:1000", 1), testKey("10.0.0.1:2000", 2)
+	c.add(first, entry{when: start, question: q})
+	c.add(retry, entry{when: start.Add(5 * time.Second), question: q})
+
+	// the first attempt is superseded by the retransmission
+	timeouts, superseded := c.timeout(start.Add(6*time.Second), 5*time.Second)
+	if len(timeouts) != 0 || len(superseded) != 1 {
+		t.Fatalf("timeouts = %d, superseded = %d, want 0 and 1", len(timeouts), len(superseded))
+	}
+
+	timeouts, _ = c.timeout(start.Add(10*time.Second), 5*time.Second)
+	if len(timeouts) != 1 || timeouts[0].attempts != 2 || !timeouts[0].first.Equal(start) {
+		t.Fatalf("timeouts = %+v, want the retransmission with 2 attempts", timeouts)
+	}
+	// the timeouts are reported once
+	if timeouts, _ = c.timeout(start.Add(11*time.Second), 5*time.Second); len(timeouts) != 0 {
+		t.Fatalf("timeouts = %d, want 0", len(timeouts))
+	}
+
+	// the late response still matches until expired
+	if _, _, ok, _ := c.take(first, q); !ok {
+		t.Fatal("take = false, want the query timed out")
+	}
+	if n := c.len(); n != 0 {
+		t.Fatalf("pending = %d, want 0", n)
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	q := testQuestion("example.com.")
+	c := newCache(16)
+	c.add(testKey("10.0.0.1:1000", 1), entry{when: start, question: q})
+	c.add(testKey("10.0.0.1:2000", 2), entry{when: start.Add(5 * time.Second), question: q})
+	c.add(testKey("10.0.0.2:1000", 1), entry{when: start.Add(5 * time.Second), question: q})
+	if n := c.len(); n != 2 {
+		t.Fatalf("pending = %d, want 2", n)
+	}
+
+	// the query isn't expired until all the attempts are
+	c.expire(start.Add(30*time.Second), 30*time.Second)
+	if n := c.expirations.Load(); n != 0 {
+		t.Fatalf("expirations = %d, want 0", n)
+	}
+	if n := c.len(); n != 2 {
+		t.Fatalf("pending = %d, want 2", n)
+	}
+
+	c.expire(start.Add(35*time.Second), 30*time.Second)
+	if n := c.expirations.Load(); n != 2 {
+		t.Fatalf("expirations = %d, want 2", n)
+	}
+	if n := c.len(); n != 0 {
+		t.Fatalf("pending = %d, want 0", n)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/chenjiandongx/dnstrack/formatter"
+)
+
+var (
+	// the innermost element of the cgroup path holding the container id, e.g.
+	// - /docker/<id>
+	// - /system.slice/docker-<id>.scope
+	// - /kubepods/burstable/pod<uid>/<id>
+	// - /kubepods.slice/.../cri-containerd-<id>.scope
+	// - /kubepods.slice/.../crio-<id>.scope
+	containerIDRegex = regexp.MustCompile(`(?:^|[-:])([0-9a-f]{64})(?:\.scope)?$`)
+
+	// the pod uid is separated by underscores in the systemd slices, e.g.
+	// kubepods-besteffort-pod<uid>.slice
+	podUIDRegex = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+)
+
+// parseCgroupFile picks the cgroup path from the content of /proc/<pid>/cgroup,
+// the unified hierarchy is preferred and the first non-root one is taken on the
+// legacy hierarchies.
+func parseCgroupFile(content string) string {
+	var legacy string
+	for _, line := range strings.Split(content, "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			return fields[2]
+		}
+		if legacy == "" && fields[2] != "/" {
+			legacy = fields[2]
+		}
+	}
+	return legacy
+}
+
+// setCgroup sets the cgroup path of the process and the container id and pod
+// uid extracted from it.
+func setCgroup(p *formatter.Process, cgroup string) {
+	p.Cgroup = cgroup
+	elems := strings.Split(cgroup, "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if m := containerIDRegex.FindStringSubmatch(elems[i]); m != nil {
+			p.ContainerID = m[1]
+			break
+		}
+	}
+	if m := podUIDRegex.FindStringSubmatch(cgroup); m != nil {
+		p.PodUID = strings.ReplaceAll(m[1], "_", "-")
+	}
+}
+
+// workloadKey groups the processes by the pod and container, the cgroup path is
+// used for the ones outside containers.
+func workloadKey(p *formatter.Process) string {
+	switch {
+	case p.ContainerID != "" && p.PodUID != "":
+		return "pod:" + p.PodUID + "/container:" + p.ContainerID[:12]
+	case p.ContainerID != "":
+		return "container:" + p.ContainerID[:12]
+	case p.PodUID != "":
+		return "pod:" + p.PodUID
+	}
+	return p.Cgroup
+}
+
+// workloadFilter limits the tracking to the processes of a cgroup or container.
+type workloadFilter struct {
+	cgroup    string
+	container string
+}
+
+func (f workloadFilter) active() bool {
+	return f.cgroup != "" || f.container != ""
+}
+
+// pass tells whether the process belongs to the workload. The cgroup matches
+// itself and the descendants, and the container id could be shortened, e.g. the
+// 12 characters one.
+func (f workloadFilter) pass(p *formatter.Process) bool {
+	if f.cgroup != "" {
+		if p == nil || (p.Cgroup != f.cgroup && !strings.HasPrefix(p.Cgroup, strings.TrimSuffix(f.cgroup, "/")+"/")) {
+			return false
+		}
+	}
+	if f.container != "" {
+		if p == nil || p.ContainerID == "" || !strings.HasPrefix(p.ContainerID, f.container) {
+			return false
+		}
+	}
+	return true
+}
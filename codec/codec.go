@@ -14,13 +14,16 @@ type Header struct {
 	ID       uint16 `json:"id" yaml:"id"`
 	OpCode   string `json:"opcode" yaml:"opcode"`
 	Status   string `json:"status" yaml:"status"`
-	Response bool   `json:"-" yaml:"-"`
+	Response bool   `json:"response" yaml:"response"`
 }
 
 // Question the question for the name server
 type Question struct {
 	Name string `json:"name" yaml:"name"`
 	Type string `json:"type" yaml:"type"`
+
+	// Unicast is the mDNS unicast-response bit, see RFC 6762 5.4
+	Unicast bool `json:"unicast,omitempty" yaml:"unicast,omitempty"`
 }
 
 // Answer RRs answering the question
@@ -30,24 +33,33 @@ type Answer struct {
 	TTL    uint32 `json:"ttl" yaml:"ttl"`
 	Class  string `json:"class" yaml:"class"`
 	Record string `json:"record" yaml:"record"`
+
+	// CacheFlush is the mDNS cache-flush bit, see RFC 6762 10.2
+	CacheFlush bool `json:"cache_flush,omitempty" yaml:"cache_flush,omitempty"`
 }
 
 // Authority RRs pointing toward an authority
 type Authority struct {
-	Name   string `json:"name" yaml:"name"`
-	Type   string `json:"type" yaml:"type"`
-	Class  string `json:"class" yaml:"class"`
-	Record string `json:"record" yaml:"record"`
+	Name       string `json:"name" yaml:"name"`
+	Type       string `json:"type" yaml:"type"`
+	Class      string `json:"class" yaml:"class"`
+	Record     string `json:"record" yaml:"record"`
+	CacheFlush bool   `json:"cache_flush,omitempty" yaml:"cache_flush,omitempty"`
 }
 
 // Additional RRs holding additional information
 type Additional struct {
-	Name   string `json:"name" yaml:"name"`
-	Type   string `json:"type" yaml:"type"`
-	Class  string `json:"class" yaml:"class"`
-	Record string `json:"record" yaml:"record"`
+	Name       string `json:"name" yaml:"name"`
+	Type       string `json:"type" yaml:"type"`
+	Class      string `json:"class" yaml:"class"`
+	Record     string `json:"record" yaml:"record"`
+	CacheFlush bool   `json:"cache_flush,omitempty" yaml:"cache_flush,omitempty"`
 }
 
+// mdnsClassBit is the top bit of the class field which is borrowed by mDNS as
+// the unicast-response bit in questions and the cache-flush bit in records.
+const mdnsClassBit = 0x8000
+
 func ClassMapping(class dnsmessage.Class) string {
 	mapping := map[dnsmessage.Class]string{
 		dnsmessage.ClassINET:   "INET",
@@ -106,6 +118,15 @@ func StatusMapping(code dnsmessage.RCode) string {
 		dnsmessage.RCodeNameError:      "NameError",
 		dnsmessage.RCodeNotImplemented: "NotImplemented",
 		dnsmessage.RCodeRefused:        "Refused",
+
+		// the extended ones need the upper bits carried in the OPT RR
+		dnsmessage.RCode(6):  "YXDomain",
+		dnsmessage.RCode(7):  "YXRRSet",
+		dnsmessage.RCode(8):  "NXRRSet",
+		dnsmessage.RCode(9):  "NotAuth",
+		dnsmessage.RCode(10): "NotZone",
+		dnsmessage.RCode(16): "BadVersion",
+		dnsmessage.RCode(23): "BadCookie",
 	}
 
 	v, ok := mapping[code]
@@ -142,21 +163,35 @@ type Message struct {
 	AnswerSec     []Answer     `json:"answer" yaml:"answer"`
 	AuthoritySec  []Authority  `json:"authority" yaml:"authority"`
 	AdditionalSec []Additional `json:"additional" yaml:"additional"`
+
+	// OPT is the EDNS(0) pseudo RR, nil if the message doesn't carry one
+	OPT *OPT `json:"opt,omitempty" yaml:"opt,omitempty"`
 }
 
 type decoder struct {
-	p dnsmessage.Parser
-	b []byte
-	m *Message
+	p    dnsmessage.Parser
+	b    []byte
+	m    *Message
+	mdns bool
+
+	// rcode is the lower 4 bits of the response code in the header
+	rcode dnsmessage.RCode
 }
 
 func Decode(b []byte) (*Message, error) {
-	return newDecoder(b).decode()
+	return newDecoder(b, false).decode()
+}
+
+// DecodeMDNS decodes the multicast dns message whose top bit of the class field
+// has a special meaning.
+func DecodeMDNS(b []byte) (*Message, error) {
+	return newDecoder(b, true).decode()
 }
 
-func newDecoder(b []byte) *decoder {
+func newDecoder(b []byte, mdns bool) *decoder {
 	return &decoder{
-		b: b,
+		b:    b,
+		mdns: mdns,
 		m: &Message{
 			AnswerSec:     []Answer{},
 			AuthoritySec:  []Authority{},
@@ -240,6 +275,7 @@ func (d *decoder) decodeHeader() error {
 		return err
 	}
 
+	d.rcode = header.RCode
 	d.m.Header = Header{
 		ID:       header.ID,
 		OpCode:   OpCodeMapping(header.OpCode),
@@ -292,6 +328,7 @@ func (d *decoder) decodeQuestion() error {
 
 		d.m.QuestionSec.Name = q.Name.String()
 		d.m.QuestionSec.Type = TypeMapping(q.Type)
+		d.m.QuestionSec.Unicast = d.mdns && q.Class&mdnsClassBit != 0
 		if err := d.p.SkipAllQuestions(); err != nil {
 			return err
 		}
@@ -346,6 +383,14 @@ TTL             a 32 bit unsigned integer that specifies the time
                 interpreted to mean that the RR can only be used for the
                 transaction in progress, and should not be cached.
 */
+// splitClass splits the mDNS cache-flush bit from the class
+func (d *decoder) splitClass(class dnsmessage.Class) (dnsmessage.Class, bool) {
+	if !d.mdns {
+		return class, false
+	}
+	return class &^ mdnsClassBit, class&mdnsClassBit != 0
+}
+
 // parseResourceRecord parse resource records from dnsmessage.Type
 func (d *decoder) parseResourceRecord(t dnsmessage.Type) (string, bool, error) {
 	var unknown bool
@@ -455,11 +500,13 @@ func (d *decoder) decodeAnswer() error {
 			break
 		}
 
+		class, flush := d.splitClass(h.Class)
 		answer := Answer{
-			Name:  h.Name.String(),
-			TTL:   h.TTL,
-			Class: ClassMapping(h.Class),
-			Type:  TypeMapping(h.Type),
+			Name:       h.Name.String(),
+			TTL:        h.TTL,
+			Class:      ClassMapping(class),
+			Type:       TypeMapping(h.Type),
+			CacheFlush: flush,
 		}
 
 		record, unknown, err := d.parseResourceRecord(h.Type)
@@ -487,11 +534,13 @@ func (d *decoder) decodeAuthority() error {
 			return err
 		}
 		if !unknown {
+			class, flush := d.splitClass(h.Class)
 			d.m.AuthoritySec = append(d.m.AuthoritySec, Authority{
-				Name:   h.Name.String(),
-				Type:   TypeMapping(h.Type),
-				Class:  ClassMapping(h.Class),
-				Record: record,
+				Name:       h.Name.String(),
+				Type:       TypeMapping(h.Type),
+				Class:      ClassMapping(class),
+				Record:     record,
+				CacheFlush: flush,
 			})
 		}
 	}
@@ -507,9 +556,18 @@ func (d *decoder) decodeAdditional() error {
 			break
 		}
 
+		if r, ok := h.Body.(*dnsmessage.OPTResource); ok {
+			d.m.OPT = decodeOPT(h.Header, r)
+			// the upper 8 bits of the 12 bits response code
+			d.m.Header.Status = StatusMapping(dnsmessage.RCode(d.m.OPT.ExtendedRCode)<<4 | d.rcode)
+			continue
+		}
+
+		class, flush := d.splitClass(h.Header.Class)
 		additional := Additional{
-			Name:  h.Header.Name.String(),
-			Class: ClassMapping(h.Header.Class),
+			Name:       h.Header.Name.String(),
+			Class:      ClassMapping(class),
+			CacheFlush: flush,
 		}
 
 		switch r := h.Body.(type) {
@@ -0,0 +1,258 @@
+package codec
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// OPT the EDNS(0) pseudo RR carried in the additional section
+type OPT struct {
+	UDPSize       uint16 `json:"udp_size" yaml:"udp_size"`
+	Version       uint8  `json:"version" yaml:"version"`
+	ExtendedRCode uint8  `json:"extended_rcode" yaml:"extended_rcode"`
+	DO            bool   `json:"do" yaml:"do"`
+
+	// Flags is the whole 16 bits flags field including the DO bit
+	Flags   uint16       `json:"flags" yaml:"flags"`
+	Options []EDNSOption `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// EDNSOption the option of the OPT RR, the known ones are decoded into the
+// typed fields and the others are kept in hex.
+type EDNSOption struct {
+	Code uint16 `json:"code" yaml:"code"`
+	Name string `json:"name" yaml:"name"`
+
+	ClientSubnet  *ClientSubnet  `json:"client_subnet,omitempty" yaml:"client_subnet,omitempty"`
+	Cookie        *Cookie        `json:"cookie,omitempty" yaml:"cookie,omitempty"`
+	Keepalive     *Keepalive     `json:"keepalive,omitempty" yaml:"keepalive,omitempty"`
+	ExtendedError *ExtendedError `json:"extended_error,omitempty" yaml:"extended_error,omitempty"`
+	NSID          string         `json:"nsid,omitempty" yaml:"nsid,omitempty"`
+	Padding       int            `json:"padding,omitempty" yaml:"padding,omitempty"`
+	Data          string         `json:"data,omitempty" yaml:"data,omitempty"`
+}
+
+// ClientSubnet the EDNS Client Subnet option, see RFC 7871
+type ClientSubnet struct {
+	Family       uint16 `json:"family" yaml:"family"`
+	SourcePrefix uint8  `json:"source_prefix" yaml:"source_prefix"`
+	ScopePrefix  uint8  `json:"scope_prefix" yaml:"scope_prefix"`
+	Address      string `json:"address" yaml:"address"`
+}
+
+// Cookie the DNS cookies option in hex, see RFC 7873
+type Cookie struct {
+	Client string `json:"client" yaml:"client"`
+	Server string `json:"server,omitempty" yaml:"server,omitempty"`
+}
+
+// Keepalive the edns-tcp-keepalive option, the timeout is absent in queries,
+// see RFC 7828
+type Keepalive struct {
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// ExtendedError the Extended DNS Errors option, see RFC 8914
+type ExtendedError struct {
+	InfoCode  uint16 `json:"info_code" yaml:"info_code"`
+	Info      string `json:"info" yaml:"info"`
+	ExtraText string `json:"extra_text,omitempty" yaml:"extra_text,omitempty"`
+}
+
+const (
+	optionNSID      = 3
+	optionECS       = 8
+	optionCookie    = 10
+	optionKeepalive = 11
+	optionPadding   = 12
+	optionEDE       = 15
+)
+
+func OptionMapping(code uint16) string {
+	mapping := map[uint16]string{
+		optionNSID:      "NSID",
+		optionECS:       "ECS",
+		optionCookie:    "COOKIE",
+		optionKeepalive: "KEEPALIVE",
+		optionPadding:   "PADDING",
+		optionEDE:       "EDE",
+	}
+
+	v, ok := mapping[code]
+	if ok {
+		return v
+	}
+	return fmt.Sprintf("%d", code)
+}
+
+// ExtendedErrorMapping maps the info codes registered by IANA
+func ExtendedErrorMapping(code uint16) string {
+	mapping := map[uint16]string{
+		0:  "Other",
+		1:  "Unsupported DNSKEY Algorithm",
+		2:  "Unsupported DS Digest Type",
+		3:  "Stale Answer",
+		4:  "Forged Answer",
+		5:  "DNSSEC Indeterminate",
+		6:  "DNSSEC Bogus",
+		7:  "Signature Expired",
+		8:  "Signature Not Yet Valid",
+		9:  "DNSKEY Missing",
+		10: "RRSIGs Missing",
+		11: "No Zone Key Bit Set",
+		12: "NSEC Missing",
+		13: "Cached Error",
+		14: "Not Ready",
+		15: "Blocked",
+		16: "Censored",
+		17: "Filtered",
+		18: "Prohibited",
+		19: "Stale NXDOMAIN Answer",
+		20: "Not Authoritative",
+		21: "Not Supported",
+		22: "No Reachable Authority",
+		23: "Network Error",
+		24: "Invalid Data",
+		25: "Signature Expired before Valid",
+		26: "Too Early",
+		27: "Unsupported NSEC3 Iterations Value",
+		28: "Unable to conform to policy",
+		29: "Synthesized",
+	}
+
+	v, ok := mapping[code]
+	if ok {
+		return v
+	}
+	return fmt.Sprintf("%d", code)
+}
+
+/*
+ref: https://www.rfc-editor.org/rfc/rfc6891
+6.1.2. Wire Format
+
+       +------------+--------------+------------------------------+
+       | Field Name | Field Type   | Description                  |
+       +------------+--------------+------------------------------+
+       | NAME       | domain name  | MUST be 0 (root domain)      |
+       | TYPE       | u_int16_t    | OPT (41)                     |
+       | CLASS      | u_int16_t    | requestor's UDP payload size |
+       | TTL        | u_int32_t    | extended RCODE and flags     |
+       | RDLEN      | u_int16_t    | length of all RDATA          |
+       | RDATA      | octet stream | {attribute,value} pairs      |
+       +------------+--------------+------------------------------+
+
+6.1.3. OPT Record TTL Field Use
+
+                  +0 (MSB)                            +1 (LSB)
+       +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+    0: |         EXTENDED-RCODE        |            VERSION            |
+       +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+    2: | DO|                           Z                               |
+       +---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+---+
+*/
+// decodeOPT decodes the OPT RR, the class field is the UDP payload size and
+// never carries the mDNS bit.
+func decodeOPT(h dnsmessage.ResourceHeader, r *dnsmessage.OPTResource) *OPT {
+	opt := &OPT{
+		UDPSize:       uint16(h.Class),
+		ExtendedRCode: uint8(h.TTL >> 24),
+		Version:       uint8(h.TTL >> 16),
+		DO:            h.TTL&0x8000 != 0,
+		Flags:         uint16(h.TTL),
+	}
+
+	for _, o := range r.Options {
+		option := EDNSOption{Code: o.Code, Name: OptionMapping(o.Code)}
+		if !decodeOption(&option, o.Data) {
+			option.Data = hex.EncodeToString(o.Data)
+		}
+		opt.Options = append(opt.Options, option)
+	}
+	return opt
+}
+
+// decodeOption decodes the known option, it reports false if the option is
+// unknown or malformed.
+func decodeOption(option *EDNSOption, b []byte) bool {
+	switch option.Code {
+	case optionNSID:
+		option.NSID = printable(b)
+
+	case optionECS:
+		// FAMILY(2) SOURCE PREFIX-LENGTH(1) SCOPE PREFIX-LENGTH(1) ADDRESS
+		if len(b) < 4 {
+			return false
+		}
+		ecs := &ClientSubnet{Family: binary.BigEndian.Uint16(b), SourcePrefix: b[2], ScopePrefix: b[3]}
+		var ip net.IP
+		switch ecs.Family {
+		case 1:
+			ip = make(net.IP, net.IPv4len)
+		case 2:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return false
+		}
+		addr := b[4:]
+		if len(addr) > len(ip) || len(addr) != (int(ecs.SourcePrefix)+7)/8 {
+			return false
+		}
+		copy(ip, addr)
+		ecs.Address = fmt.Sprintf("%s/%d", ip, ecs.SourcePrefix)
+		option.ClientSubnet = ecs
+
+	case optionCookie:
+		// the client cookie is 8 bytes and the server one is 8 to 32 bytes
+		if len(b) != 8 && (len(b) < 16 || len(b) > 40) {
+			return false
+		}
+		option.Cookie = &Cookie{Client: hex.EncodeToString(b[:8]), Server: hex.EncodeToString(b[8:])}
+
+	case optionKeepalive:
+		// the timeout is in units of 100 milliseconds
+		switch len(b) {
+		case 0:
+			option.Keepalive = &Keepalive{}
+		case 2:
+			option.Keepalive = &Keepalive{Timeout: time.Duration(binary.BigEndian.Uint16(b)) * 100 * time.Millisecond}
+		default:
+			return false
+		}
+
+	case optionPadding:
+		option.Padding = len(b)
+
+	case optionEDE:
+		// INFO-CODE(2) EXTRA-TEXT
+		if len(b) < 2 {
+			return false
+		}
+		code := binary.BigEndian.Uint16(b)
+		option.ExtendedError = &ExtendedError{
+			InfoCode:  code,
+			Info:      ExtendedErrorMapping(code),
+			ExtraText: string(b[2:]),
+		}
+
+	default:
+		return false
+	}
+	return true
+}
+
+// printable returns the string if all the bytes are printable ascii, otherwise
+// the hex.
+func printable(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,179 @@
+package codec
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeOption(t *testing.T) {
+	tests := []struct {
+		name string
+		code uint16
+		data string // hex
+		want EDNSOption
+		ok   bool
+	}{
+		{
+			name: "nsid printable",
+			code: optionNSID,
+			data: hex.EncodeToString([]byte("ns1.example")),
+			want: EDNSOption{NSID: "ns1.example"},
+			ok:   true,
+		},
+		{
+			name: "nsid binary",
+			code: optionNSID,
+			data: "00ff10",
+			want: EDNSOption{NSID: "00ff10"},
+			ok:   true,
+		},
+		{
+			name: "ecs ipv4",
+			code: optionECS,
+			data: "00011800" + "c00002",
+			want: EDNSOption{ClientSubnet: &ClientSubnet{Family: 1, SourcePrefix: 24, Address: "192.0.2.0/24"}},
+			ok:   true,
+		},
+		{
+			name: "ecs ipv6",
+			code: optionECS,
+			data: "00023830" + "20010db80000ab",
+			want: EDNSOption{ClientSubnet: &ClientSubnet{Family: 2, SourcePrefix: 56, ScopePrefix: 48, Address: "2001:db8:0:ab00::/56"}},
+			ok:   true,
+		},
+		{
+			name: "ecs zero prefix",
+			code: optionECS,
+			data: "00010000",
+			want: EDNSOption{ClientSubnet: &ClientSubnet{Family: 1, Address: "0.0.0.0/0"}},
+			ok:   true,
+		},
+		{
+			name: "ecs truncated header",
+			code: optionECS,
+			data: "000118",
+		},
+		{
+			name: "ecs unknown family",
+			code: optionECS,
+			data: "00031800" + "c00002",
+		},
+		{
+			name: "ecs address longer than prefix",
+			code: optionECS,
+			data: "00011000" + "c00002",
+		},
+		{
+			name: "ecs address shorter than prefix",
+			code: optionECS,
+			data: "00011800" + "c000",
+		},
+		{
+			name: "ecs ipv4 prefix too long",
+			code: optionECS,
+			data: "00012100" + "c0000201ff",
+		},
+		{
+			name: "cookie client",
+			code: optionCookie,
+			data: "0102030405060708",
+			want: EDNSOption{Cookie: &Cookie{Client: "0102030405060708"}},
+			ok:   true,
+		},
+		{
+			name: "cookie server min",
+			code: optionCookie,
+			data: "0102030405060708" + "1112131415161718",
+			want: EDNSOption{Cookie: &Cookie{Client: "0102030405060708", Server: "1112131415161718"}},
+			ok:   true,
+		},
+		{
+			name: "cookie server max",
+			code: optionCookie,
+			data: "0102030405060708" + strings.Repeat("ab", 32),
+			want: EDNSOption{Cookie: &Cookie{Client: "0102030405060708", Server: strings.Repeat("ab", 32)}},
+			ok:   true,
+		},
+		{
+			name: "cookie too short",
+			code: optionCookie,
+			data: "01020304050607",
+		},
+		{
+			name: "cookie server too short",
+			code: optionCookie,
+			data: "0102030405060708" + "11121314151617",
+		},
+		{
+			name: "cookie server too long",
+			code: optionCookie,
+			data: "0102030405060708" + strings.Repeat("ab", 33),
+		},
+		{
+			name: "keepalive query",
+			code: optionKeepalive,
+			want: EDNSOption{Keepalive: &Keepalive{}},
+			ok:   true,
+		},
+		{
+			name: "keepalive timeout",
+			code: optionKeepalive,
+			data: "0096",
+			want: EDNSOption{Keepalive: &Keepalive{Timeout: 15 * time.Second}},
+			ok:   true,
+		},
+		{
+			name: "keepalive odd length",
+			code: optionKeepalive,
+			data: "00",
+		},
+		{
+			name: "padding",
+			code: optionPadding,
+			data: "00000000",
+			want: EDNSOption{Padding: 4},
+			ok:   true,
+		},
+		{
+			name: "ede with text",
+			code: optionEDE,
+			data: "0003" + hex.EncodeToString([]byte("stale")),
+			want: EDNSOption{ExtendedError: &ExtendedError{InfoCode: 3, Info: "Stale Answer", ExtraText: "stale"}},
+			ok:   true,
+		},
+		{
+			name: "ede truncated",
+			code: optionEDE,
+			data: "00",
+		},
+		{
+			name: "unknown code",
+			code: 65001,
+			data: "0102",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := EDNSOption{Code: tt.code}
+			ok := decodeOption(&got, b)
+			if ok != tt.ok {
+				t.Fatalf("decodeOption() = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			tt.want.Code = tt.code
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeOption() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
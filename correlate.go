@@ -0,0 +1,297 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chenjiandongx/dnstrack/formatter"
+)
+
+const (
+	// correlateGrace is how long the answered resolutions wait for the hops
+	// which are processed out of order, e.g. the ones captured on the other
+	// devices.
+	correlateGrace = time.Second
+
+	// correlateTTL bounds the resolutions with unanswered hops
+	correlateTTL = 30 * time.Second
+
+	// egressInterval is how often the source addresses routed to the upstreams
+	// are looked up again
+	egressInterval = 10 * time.Second
+)
+
+// hop is a transaction of the resolution, e.g. the client to the stub resolver
+// or the stub resolver to the upstream.
+type hop struct {
+	client   netip.AddrPort
+	server   netip.AddrPort
+	sent     time.Time
+	answered time.Time
+	done     bool
+	// abandoned is set once the hop is given up, it's still answered late
+	abandoned bool
+
+	// wrap is the answered transaction displayed for the root hop
+	wrap formatter.MessageWrap
+	// frames are the frames of the transaction written once displayed
+	frames []capturedFrame
+}
+
+// resolution is the lookup resolved through one or more hops, a query asking
+// the same question while the lookup is in flight is taken as its hop if it's
+// forwarded by the server of a hop or forwarded to by the client of one. The first hop is the root
+// and the innermost ones are the upstreams.
+type resolution struct {
+	id    uint64
+	first time.Time
+	last  time.Time
+	open  int
+	hops  []*hop
+}
+
+// correlator links the transactions of the same lookup, it's safe for
+// concurrent use.
+type correlator struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[txQuestion][]*resolution
+
+	egresses      map[netip.Addr]netip.Addr
+	egressUpdated time.Time
+}
+
+func newCorrelator() *correlator {
+	return &correlator{active: make(map[txQuestion][]*resolution)}
+}
+
+// foldQuestion lowers the name since the resolvers may randomize the case of
+// the upstream queries, see draft-vixie-dnsext-dns0x20.
+func foldQuestion(q txQuestion) txQuestion {
+	for i := 0; i < int(q.name.Length); i++ {
+		if b := q.name.Data[i]; b >= 'A' && b <= 'Z' {
+			q.name.Data[i] = b + 'a' - 'A'
+		}
+	}
+	return q
+}
+
+// open adds the query as a hop of the resolution in flight or a new one, the
+// resolutions of the question answered for the grace period are returned.
+func (c *correlator) open(q txQuestion, client, server netip.AddrPort, ts time.Time) (*resolution, *hop, []*resolution) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := foldQuestion(q)
+	h := &hop{client: client, server: server, sent: ts}
+
+	var joined *resolution
+	var finished []*resolution
+	active := c.active[key][:0]
+	for _, r := range c.active[key] {
+		if r.open == 0 && ts.Sub(r.last) >= correlateGrace {
+			finished = append(finished, r)
+			continue
+		}
+		active = append(active, r)
+		if joined == nil && c.chained(r, h) {
+			joined = r
+		}
+	}
+
+	if joined != nil {
+		joined.hops = append(joined.hops, h)
+		joined.open++
+		if ts.Before(joined.first) {
+			joined.first = ts
+		}
+	} else {
+		c.nextID++
+		joined = &resolution{id: c.nextID, first: ts, open: 1, hops: []*hop{h}}
+		active = append(active, joined)
+	}
+	c.active[key] = active
+	return joined, h, finished
+}
+
+// chained tells whether the hop is forwarded by the server of a hop of the
+// resolution or the other way around since the hops captured on the devices
+// may be processed out of order. The hops to the same server are the lookups of
+// the unrelated clients.
+func (c *correlator) chained(r *resolution, h *hop) bool {
+	for _, o := range r.hops {
+		if o.server == h.server {
+			continue
+		}
+		if c.forwards(o, h) || c.forwards(h, o) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwards tells whether the upstream hop is sent by the resolver serving the
+// hop, the local resolvers listening on the loopback addresses send the upstream
+// queries from the source addresses routed to the upstreams.
+func (c *correlator) forwards(h, upstream *hop) bool {
+	server, client := h.server.Addr(), upstream.client.Addr()
+	if server == client {
+		return true
+	}
+	if !server.IsLoopback() {
+		return false
+	}
+	src := c.egress(upstream.server.Addr())
+	return src.IsValid() && src == client
+}
+
+// egress returns the source address routed to the address, it's invalid if no
+// routes.
+func (c *correlator) egress(addr netip.Addr) netip.Addr {
+	if time.Since(c.egressUpdated) >= egressInterval {
+		c.egresses = make(map[netip.Addr]netip.Addr)
+		c.egressUpdated = time.Now()
+	}
+	if src, ok := c.egresses[addr]; ok {
+		return src
+	}
+
+	// connecting the udp socket picks the source address without sending
+	var src netip.Addr
+	if conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, 53))); err == nil {
+		src = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+		conn.Close()
+	}
+	c.egresses[addr] = src
+	return src
+}
+
+// answer marks the hop answered, the frames are written along with the
+// resolution.
+func (c *correlator) answer(r *resolution, h *hop, ts time.Time, wrap formatter.MessageWrap, frames []capturedFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h.answered, h.done, h.wrap, h.frames = ts, true, wrap, frames
+	if !h.abandoned {
+		r.open--
+	}
+	if ts.After(r.last) {
+		r.last = ts
+	}
+}
+
+// abandon gives up the hop unanswered, it's a no-op if given up already.
+func (c *correlator) abandon(r *resolution, h *hop) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h.abandoned || h.done {
+		return
+	}
+	h.abandoned = true
+	r.open--
+}
+
+// expire removes the resolutions answered for the grace period and the stale
+// ones, the answered ones are returned, all of them are if now is zero.
+func (c *correlator) expire(now time.Time) []*resolution {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var finished []*resolution
+	for key, rs := range c.active {
+		active := rs[:0]
+		for _, r := range rs {
+			switch {
+			case r.open == 0 && (now.IsZero() || now.Sub(r.last) >= correlateGrace):
+				finished = append(finished, r)
+			case now.IsZero() || now.Sub(r.first) >= correlateTTL:
+			default:
+				active = append(active, r)
+			}
+		}
+		if len(active) == 0 {
+			delete(c.active, key)
+		} else {
+			c.active[key] = active
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].first.Before(finished[j].first)
+	})
+	return finished
+}
+
+// collapse returns the root hop along with the end-to-end view, false if the
+// root is unanswered. The upstream latency is the time covered by the innermost
+// hops and the rest of the end-to-end latency is spent locally.
+func (r *resolution) collapse() (formatter.MessageWrap, bool) {
+	hops := make([]*hop, len(r.hops))
+	copy(hops, r.hops)
+	sort.Slice(hops, func(i, j int) bool {
+		return hops[i].sent.Before(hops[j].sent)
+	})
+
+	root := hops[0]
+	if !root.done {
+		return formatter.MessageWrap{}, false
+	}
+
+	var leaves []*hop
+	for _, h := range hops[1:] {
+		if !h.done {
+			continue
+		}
+		leaf := true
+		for _, o := range hops[1:] {
+			if o != h && o.done && !o.sent.Before(h.sent) && !o.answered.After(h.answered) && (o.sent != h.sent || o.answered != h.answered) {
+				leaf = false
+				break
+			}
+		}
+		if leaf {
+			leaves = append(leaves, h)
+		}
+	}
+
+	// the leaves are sorted by the sent time, the overlapped ones are merged
+	var upstream time.Duration
+	var end time.Time
+	for _, h := range leaves {
+		start := h.sent
+		if start.Before(end) {
+			start = end
+		}
+		if h.answered.After(start) {
+			upstream += h.answered.Sub(start)
+			end = h.answered
+		}
+	}
+
+	total := root.answered.Sub(root.sent)
+	local := total - upstream
+	if local < 0 {
+		local = 0
+	}
+
+	wrap := root.wrap
+	wrap.Duration = total
+	wrap.Event = "resolution"
+	wrap.Correlation = r.id
+	answered := 0
+	for _, h := range hops {
+		if h.done {
+			answered++
+		}
+	}
+	wrap.Resolution = &formatter.Resolution{
+		Hops:     answered,
+		Upstream: upstream,
+		Local:    local,
+	}
+	return wrap, true
+}
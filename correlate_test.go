@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCorrelatorOpen(t *testing.T) {
+	type query struct {
+		client string
+		server string
+	}
+	tests := []struct {
+		name    string
+		queries []query
+		// want is the resolution index of each query in the order of opening
+		want []int
+	}{
+		{
+			name: "forwarded by the resolver",
+			queries: []query{
+				{client: "10.0.0.2:40000", server: "10.0.0.1:53"},
+				{client: "10.0.0.1:50000", server: "192.0.2.1:53"},
+			},
+			want: []int{0, 0},
+		},
+		{
+			name: "upstream processed first",
+			queries: []query{
+				{client: "10.0.0.1:50000", server: "192.0.2.1:53"},
+				{client: "10.0.0.2:40000", server: "10.0.0.1:53"},
+			},
+			want: []int{0, 0},
+		},
+		{
+			name: "clients of the same resolver",
+			queries: []query{
+				{client: "10.0.0.2:40000", server: "10.0.0.1:53"},
+				{client: "10.0.0.3:40000", server: "10.0.0.1:53"},
+			},
+			want: []int{0, 1},
+		},
+		{
+			name: "local clients of the stub",
+			queries: []query{
+				{client: "127.0.0.1:40000", server: "127.0.0.53:53"},
+				{client: "127.0.0.1:40001", server: "127.0.0.53:53"},
+			},
+			want: []int{0, 1},
+		},
+		{
+			name: "stub forwarding to the local upstream",
+			queries: []query{
+				{client: "127.0.0.1:40000", server: "127.0.0.53:53"},
+				{client: "127.0.0.1:50000", server: "127.0.0.1:5353"},
+			},
+			want: []int{0, 0},
+		},
+		{
+			name: "unrelated servers",
+			queries: []query{
+				{client: "10.0.0.2:40000", server: "10.0.0.1:53"},
+				{client: "10.0.0.4:50000", server: "192.0.2.1:53"},
+			},
+			want: []int{0, 1},
+		},
+	}
+
+	start := time.Unix(1700000000, 0)
+	q := testQuestion("example.com.")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCorrelator()
+			var resolutions []*resolution
+			for i, query := range tt.queries {
+				r, _, _ := c.open(q, netip.MustParseAddrPort(query.client), netip.MustParseAddrPort(query.server), start.Add(time.Duration(i)*time.Millisecond))
+				idx := len(resolutions)
+				for j := range resolutions {
+					if resolutions[j] == r {
+						idx = j
+					}
+				}
+				if idx == len(resolutions) {
+					resolutions = append(resolutions, r)
+				}
+				if idx != tt.want[i] {
+					t.Fatalf("query %d: resolution %d, want %d", i, idx, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// dlt is the link type of the captured frames in terms of the LINKTYPE_ values
+// written to the pcap files. gopacket keeps the link type in uint8 which can't
+// hold the ones above 255 like LINKTYPE_LINUX_SLL2.
+// see https://www.tcpdump.org/linktypes.html
+type dlt uint16
+
+const (
+	dltNull      dlt = 0
+	dltEthernet  dlt = 1
+	dltRaw       dlt = 101
+	dltLoop      dlt = 108
+	dltLinuxSLL  dlt = 113
+	dltIPv4      dlt = 228
+	dltIPv6      dlt = 229
+	dltLinuxSLL2 dlt = 276
+)
+
+// dltNames maps the names libpcap gives to the supported link types, the values
+// reported by libpcap are platform specific for some of them, e.g. DLT_RAW.
+var dltNames = map[string]dlt{
+	"NULL":       dltNull,
+	"EN10MB":     dltEthernet,
+	"RAW":        dltRaw,
+	"LOOP":       dltLoop,
+	"LINUX_SLL":  dltLinuxSLL,
+	"IPV4":       dltIPv4,
+	"IPV6":       dltIPv6,
+	"LINUX_SLL2": dltLinuxSLL2,
+}
+
+func (t dlt) String() string {
+	for name, v := range dltNames {
+		if v == t {
+			return name
+		}
+	}
+	return strconv.Itoa(int(t))
+}
+
+// layersType converts the link type to the gopacket one, it reports false if the
+// link type doesn't fit in.
+func (t dlt) layersType() (layers.LinkType, bool) {
+	return layers.LinkType(t), t <= 0xff
+}
+
+// frame holds the network layer decoded from a captured frame.
+type frame struct {
+	vlans   []uint16
+	srcIP   net.IP
+	dstIP   net.IP
+	netFlow gopacket.Flow
+	proto   layers.IPProtocol
+	payload []byte
+
+	// frag is set if the payload is a piece of the fragmented datagram
+	frag *fragment
+}
+
+// parser decodes the dns packets from the frames captured on a device, it's not
+// safe for concurrent use.
+type parser struct {
+	device    string
+	linkType  dlt
+	ports     dnsPorts
+	multicast bool
+	netns     uint64
+	tcp       *tcpAssembler
+	defrag    *defragmenter
+
+	// keepFrames is set if the matched transactions are written to file, the
+	// frames of the fragments are kept for the messages then
+	keepFrames bool
+}
+
+// newParser creates the parser, netns is the inode of the network namespace the
+// device is in which is 0 for the files.
+func newParser(common *CommonClient, device string, linkType dlt, ports dnsPorts, multicast bool, netns uint64) *parser {
+	return &parser{
+		device:    device,
+		linkType:  linkType,
+		ports:     ports,
+		multicast: multicast,
+		netns:     netns,
+		tcp:       newTCPAssembler(common, device, linkType, ports, netns),
+		defrag:    newDefragmenter(),
+
+		keepFrames: common.w != nil && common.w.matched,
+	}
+}
+
+// parse decodes the udp dns packet from the frame, tcp segments are fed to the
+// assembler and nil is returned.
+func (p *parser) parse(data []byte, ts time.Time) *SP {
+	f, ok := decodeFrame(p.linkType, data)
+	if !ok {
+		return nil
+	}
+	var frames []capturedFrame
+	if f.frag != nil {
+		var raw []byte
+		if p.keepFrames {
+			raw = data
+		}
+		if f.proto, f.payload, frames, ok = p.defrag.add(f, raw, ts); !ok {
+			return nil
+		}
+		for i := range frames {
+			frames[i].device, frames[i].linkType = p.device, p.linkType
+		}
+		// the extension headers following the fragment header are fragmentable
+		if f.srcIP.To4() == nil {
+			var frag *fragment
+			if f.proto, f.payload, frag, ok = skipIPv6Extensions(f.proto, f.payload); !ok || frag != nil {
+				return nil
+			}
+		}
+	}
+
+	switch f.proto {
+	case layers.IPProtocolUDP:
+		var pkg layers.UDP
+		if err := pkg.DecodeFromBytes(f.payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil
+		}
+		srcPort, dstPort := uint16(pkg.SrcPort), uint16(pkg.DstPort)
+		server, ok := p.ports.serverAddr(f.srcIP, f.dstIP, srcPort, dstPort)
+		if !ok {
+			return nil
+		}
+
+		sp := &SP{
+			Server:    server,
+			Transport: transportUDP,
+			Payload:   pkg.Payload,
+			Src:       addrPort(f.srcIP, srcPort),
+			Dst:       addrPort(f.dstIP, dstPort),
+			VLANs:     f.vlans,
+			Netns:     p.netns,
+			Segments:  frames,
+		}
+		if p.multicast {
+			switch {
+			case srcPort == llmnrPort || dstPort == llmnrPort:
+				sp.Multicast = protocolLLMNR
+			case srcPort == mdnsPort || dstPort == mdnsPort:
+				sp.Multicast = protocolMDNS
+			}
+			if sp.Multicast != "" {
+				sp.Server = net.JoinHostPort(f.srcIP.String(), strconv.Itoa(int(srcPort)))
+			}
+		}
+		return sp
+
+	case layers.IPProtocolTCP:
+		var pkg layers.TCP
+		if err := pkg.DecodeFromBytes(f.payload, gopacket.NilDecodeFeedback); err != nil {
+			return nil
+		}
+		// the bpf lets the other tcp segments through for the fragments and ipv6
+		// extension headers
+		if _, ok := p.ports.serverAddr(f.srcIP, f.dstIP, uint16(pkg.SrcPort), uint16(pkg.DstPort)); !ok {
+			return nil
+		}
+		p.tcp.assemble(f.netFlow, &pkg, ts, data)
+	}
+
+	return nil
+}
+
+func addrPort(ip net.IP, port uint16) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), port)
+}
+
+// decodeFrame decodes packets followed by layers
+// 1) Link Layer (in terms of the link type)
+// 2) 802.1Q/802.1ad VLAN tags if any
+// 3) IP Layer
+func decodeFrame(linkType dlt, data []byte) (*frame, bool) {
+	var ethType layers.EthernetType
+	switch linkType {
+	case dltEthernet:
+		var ether layers.Ethernet
+		if err := ether.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			return nil, false
+		}
+		ethType, data = ether.EthernetType, ether.Payload
+
+	case dltLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		ethType, data = layers.EthernetType(binary.BigEndian.Uint16(data[14:16])), data[16:]
+
+	case dltLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		ethType, data = layers.EthernetType(binary.BigEndian.Uint16(data[0:2])), data[20:]
+
+	case dltNull, dltLoop:
+		var loopback layers.Loopback
+		if err := loopback.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			return nil, false
+		}
+		switch loopback.Family {
+		case layers.ProtocolFamilyIPv4:
+			ethType = layers.EthernetTypeIPv4
+		case layers.ProtocolFamilyIPv6BSD, layers.ProtocolFamilyIPv6FreeBSD, layers.ProtocolFamilyIPv6Darwin, layers.ProtocolFamilyIPv6Linux:
+			ethType = layers.EthernetTypeIPv6
+		}
+		data = loopback.Payload
+
+	case dltRaw, dltIPv4, dltIPv6:
+		if len(data) == 0 {
+			return nil, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			ethType = layers.EthernetTypeIPv4
+		case 6:
+			ethType = layers.EthernetTypeIPv6
+		}
+
+	default:
+		return nil, false
+	}
+
+	f := &frame{}
+	for ethType == layers.EthernetTypeDot1Q || ethType == layers.EthernetTypeQinQ {
+		var tag layers.Dot1Q
+		if err := tag.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			return nil, false
+		}
+		f.vlans = append(f.vlans, tag.VLANIdentifier)
+		ethType, data = tag.Type, tag.Payload
+	}
+
+	switch ethType {
+	case layers.EthernetTypeIPv4:
+		var ipv4 layers.IPv4
+		if err := ipv4.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			return nil, false
+		}
+		f.srcIP, f.dstIP, f.netFlow = ipv4.SrcIP, ipv4.DstIP, ipv4.NetworkFlow()
+		f.proto, f.payload = ipv4.Protocol, ipv4.Payload
+		if more := ipv4.Flags&layers.IPv4MoreFragments != 0; more || ipv4.FragOffset != 0 {
+			f.frag = &fragment{id: uint32(ipv4.Id), offset: int(ipv4.FragOffset) * 8, more: more, data: ipv4.Payload}
+		}
+
+	case layers.EthernetTypeIPv6:
+		var ipv6 layers.IPv6
+		if err := ipv6.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			return nil, false
+		}
+		f.srcIP, f.dstIP, f.netFlow = ipv6.SrcIP, ipv6.DstIP, ipv6.NetworkFlow()
+		f.proto, f.payload = ipv6.NextHeader, ipv6.Payload
+		if ipv6.HopByHop != nil {
+			f.proto = ipv6.HopByHop.NextHeader
+		}
+
+		var ok bool
+		if f.proto, f.payload, f.frag, ok = skipIPv6Extensions(f.proto, f.payload); !ok {
+			return nil, false
+		}
+
+	default:
+		return nil, false
+	}
+
+	return f, true
+}
+
+// skipIPv6Extensions walks through the IPv6 extension headers chain and returns
+// the upper-layer protocol followed by its payload, it stops at the fragment
+// header of the non-atomic fragments and returns the fragment.
+func skipIPv6Extensions(proto layers.IPProtocol, data []byte) (layers.IPProtocol, []byte, *fragment, bool) {
+	for {
+		switch proto {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			var ext layers.IPv6ExtensionSkipper
+			if err := ext.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+				return 0, nil, nil, false
+			}
+			proto, data = ext.NextHeader, ext.Payload
+
+		case layers.IPProtocolIPv6Fragment:
+			if len(data) < 8 {
+				return 0, nil, nil, false
+			}
+			offset := int(binary.BigEndian.Uint16(data[2:4])>>3) * 8
+			more := data[3]&0x1 != 0
+			id := binary.BigEndian.Uint32(data[4:8])
+			proto, data = layers.IPProtocol(data[0]), data[8:]
+			// the atomic fragment (offset 0 and no more fragments) holds a whole datagram
+			if offset != 0 || more {
+				return proto, data, &fragment{id: id, offset: offset, more: more, data: data}, true
+			}
+
+		case layers.IPProtocolAH:
+			if len(data) < 2 {
+				return 0, nil, nil, false
+			}
+			n := (int(data[1]) + 2) * 4
+			if len(data) < n {
+				return 0, nil, nil, false
+			}
+			proto, data = layers.IPProtocol(data[0]), data[n:]
+
+		default:
+			return proto, data, nil, true
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	fragTimeout       = 30 * time.Second
+	fragFlushInterval = time.Second
+	fragMaxDatagrams  = 1024
+	fragMaxFragments  = 64
+	fragMaxSize       = 65535
+)
+
+// fragment is a piece of the fragmented IPv4/IPv6 datagram.
+type fragment struct {
+	id     uint32
+	offset int
+	more   bool
+	data   []byte
+}
+
+type fragKey struct {
+	src [16]byte
+	dst [16]byte
+	id  uint32
+	v6  bool
+}
+
+type fragList struct {
+	proto layers.IPProtocol
+	frags []fragment
+	size  int
+	total int // the length of datagram, -1 until the last fragment comes
+	first time.Time
+
+	// frames are the raw frames of the fragments in the order of arrival
+	frames []capturedFrame
+}
+
+// defragmenter reassembles the fragmented datagrams, the memory is bounded by
+// the number of in-flight datagrams and fragments per datagram, and the ones
+// incomplete after the timeout are discarded. It's not safe for concurrent use.
+type defragmenter struct {
+	lists     map[fragKey]*fragList
+	lastFlush time.Time
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{lists: make(map[fragKey]*fragList)}
+}
+
+// add adds the fragment and returns the whole payload followed by the protocol
+// of the first fragment once the datagram is complete, the frames of the
+// fragments are returned as well if the raw frames are given.
+func (d *defragmenter) add(f *frame, raw []byte, ts time.Time) (layers.IPProtocol, []byte, []capturedFrame, bool) {
+	d.flush(ts)
+
+	frag := f.frag
+	key := fragKey{id: frag.id, v6: f.srcIP.To4() == nil}
+	copy(key.src[:], f.srcIP.To16())
+	copy(key.dst[:], f.dstIP.To16())
+
+	end := frag.offset + len(frag.data)
+	if end > fragMaxSize {
+		delete(d.lists, key)
+		return 0, nil, nil, false
+	}
+
+	list, ok := d.lists[key]
+	if !ok {
+		if len(d.lists) >= fragMaxDatagrams {
+			d.evictOldest()
+		}
+		list = &fragList{total: -1, first: ts}
+		d.lists[key] = list
+	}
+	if len(list.frags) >= fragMaxFragments {
+		delete(d.lists, key)
+		return 0, nil, nil, false
+	}
+
+	// the retransmitted fragments are the exact duplicates which don't overlap
+	for _, prev := range list.frags {
+		if prev.offset == frag.offset && bytes.Equal(prev.data, frag.data) {
+			return 0, nil, nil, false
+		}
+	}
+
+	if frag.offset == 0 {
+		list.proto = f.proto
+	}
+	if !frag.more {
+		list.total = end
+	}
+	// the buffer of the captured frame is reused by the next read
+	list.frags = append(list.frags, fragment{offset: frag.offset, data: append([]byte(nil), frag.data...)})
+	list.size += len(frag.data)
+	if raw != nil {
+		list.frames = append(list.frames, capturedFrame{ts: ts, data: append([]byte(nil), raw...)})
+	}
+	if list.total < 0 || list.size < list.total {
+		return 0, nil, nil, false
+	}
+
+	delete(d.lists, key)
+	payload, ok := list.assemble()
+	return list.proto, payload, list.frames, ok
+}
+
+// assemble joins the fragments, the overlapping ones are dropped along with the
+// datagram as RFC 5722 requires.
+func (l *fragList) assemble() ([]byte, bool) {
+	sort.Slice(l.frags, func(i, j int) bool {
+		return l.frags[i].offset < l.frags[j].offset
+	})
+
+	payload := make([]byte, 0, l.total)
+	for _, frag := range l.frags {
+		if frag.offset != len(payload) {
+			return nil, false
+		}
+		payload = append(payload, frag.data...)
+	}
+	return payload, len(payload) == l.total
+}
+
+func (d *defragmenter) evictOldest() {
+	var oldest fragKey
+	var first time.Time
+	for key, list := range d.lists {
+		if first.IsZero() || list.first.Before(first) {
+			oldest, first = key, list.first
+		}
+	}
+	delete(d.lists, oldest)
+}
+
+func (d *defragmenter) flush(ts time.Time) {
+	if ts.Sub(d.lastFlush) < fragFlushInterval {
+		return
+	}
+	d.lastFlush = ts
+
+	for key, list := range d.lists {
+		if ts.Sub(list.first) >= fragTimeout {
+			delete(d.lists, key)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+type fragStep struct {
+	src    string
+	id     uint32
+	offset int
+	more   bool
+	data   string
+	after  time.Duration
+}
+
+func (s fragStep) frame() *frame {
+	src := s.src
+	if src == "" {
+		src = "10.0.0.1"
+	}
+	return &frame{
+		srcIP: net.ParseIP(src),
+		dstIP: net.ParseIP("10.0.0.2"),
+		proto: layers.IPProtocolUDP,
+		frag:  &fragment{id: s.id, offset: s.offset, more: s.more, data: []byte(s.data)},
+	}
+}
+
+func TestDefragmenter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []fragStep
+		want  []string
+	}{
+		{
+			name: "in order",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 8, more: false, data: "bbb"},
+			},
+			want: []string{"aaaaaaaabbb"},
+		},
+		{
+			name: "out of order",
+			steps: []fragStep{
+				{offset: 16, more: false, data: "ccc"},
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 8, more: true, data: "bbbbbbbb"},
+			},
+			want: []string{"aaaaaaaabbbbbbbbccc"},
+		},
+		{
+			name: "duplicate fragment",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 8, more: true, data: "bbbbbbbb"},
+				{offset: 16, more: false, data: "ccc"},
+			},
+			want: []string{"aaaaaaaabbbbbbbbccc"},
+		},
+		{
+			name: "duplicate last fragment",
+			steps: []fragStep{
+				{offset: 16, more: false, data: "ccc"},
+				{offset: 16, more: false, data: "ccc"},
+				{offset: 8, more: true, data: "bbbbbbbb"},
+				{offset: 0, more: true, data: "aaaaaaaa"},
+			},
+			want: []string{"aaaaaaaabbbbbbbbccc"},
+		},
+		{
+			name: "overlapping fragment",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaaaaaaaaaa"},
+				{offset: 8, more: false, data: "bbbbbbbbccc"},
+			},
+			want: nil,
+		},
+		{
+			name: "same offset with different data",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 0, more: true, data: "xxxxxxxx"},
+				{offset: 16, more: false, data: "ccc"},
+			},
+			want: nil,
+		},
+		{
+			name: "missing fragment",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 16, more: false, data: "ccc"},
+			},
+			want: nil,
+		},
+		{
+			name: "too large",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: fragMaxSize - 2, more: false, data: "ccc"},
+			},
+			want: nil,
+		},
+		{
+			name: "datagrams apart",
+			steps: []fragStep{
+				{id: 1, offset: 0, more: true, data: "aaaaaaaa"},
+				{id: 2, offset: 0, more: true, data: "xxxxxxxx"},
+				{src: "10.0.0.3", id: 1, offset: 8, more: false, data: "yyy"},
+				{id: 2, offset: 8, more: false, data: "zzz"},
+				{id: 1, offset: 8, more: false, data: "bbb"},
+			},
+			want: []string{"xxxxxxxxzzz", "aaaaaaaabbb"},
+		},
+		{
+			name: "timed out",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 8, more: false, data: "bbb", after: fragTimeout},
+			},
+			want: nil,
+		},
+		{
+			name: "within timeout",
+			steps: []fragStep{
+				{offset: 0, more: true, data: "aaaaaaaa"},
+				{offset: 8, more: false, data: "bbb", after: fragTimeout - time.Second},
+			},
+			want: []string{"aaaaaaaabbb"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDefragmenter()
+			ts := time.Unix(1700000000, 0)
+
+			var got []string
+			for _, step := range tt.steps {
+				ts = ts.Add(step.after)
+				proto, payload, _, ok := d.add(step.frame(), nil, ts)
+				if !ok {
+					continue
+				}
+				if proto != layers.IPProtocolUDP {
+					t.Errorf("proto = %s, want %s", proto, layers.IPProtocolUDP)
+				}
+				got = append(got, string(payload))
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefragmenterCopiesData(t *testing.T) {
+	d := newDefragmenter()
+	ts := time.Unix(1700000000, 0)
+
+	buf := []byte("aaaaaaaa")
+	first := fragStep{offset: 0, more: true}.frame()
+	first.frag.data = buf
+	if _, _, _, ok := d.add(first, nil, ts); ok {
+		t.Fatal("completed with the first fragment")
+	}
+	// the buffer of the captured frame is reused by the next read
+	copy(buf, "xxxxxxxx")
+
+	_, payload, _, ok := d.add(fragStep{offset: 8, data: "bbb"}.frame(), nil, ts)
+	if !ok || !bytes.Equal(payload, []byte("aaaaaaaabbb")) {
+		t.Fatalf("got %q %v, want %q", payload, ok, "aaaaaaaabbb")
+	}
+}
+
+func TestDefragmenterKeepsFrames(t *testing.T) {
+	d := newDefragmenter()
+	ts := time.Unix(1700000000, 0)
+
+	raw := []byte("frame1")
+	if _, _, _, ok := d.add(fragStep{offset: 0, more: true, data: "aaaaaaaa"}.frame(), raw, ts); ok {
+		t.Fatal("completed with the first fragment")
+	}
+	copy(raw, "xxxxxx")
+
+	_, _, frames, ok := d.add(fragStep{offset: 8, data: "bbb"}.frame(), []byte("frame2"), ts.Add(time.Millisecond))
+	if !ok {
+		t.Fatal("not completed")
+	}
+	if len(frames) != 2 || string(frames[0].data) != "frame1" || string(frames[1].data) != "frame2" {
+		t.Fatalf("got %d frames, want frame1 and frame2 in order", len(frames))
+	}
+	if !frames[1].ts.Equal(ts.Add(time.Millisecond)) {
+		t.Errorf("ts = %s, want %s", frames[1].ts, ts.Add(time.Millisecond))
+	}
+}
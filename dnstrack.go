@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // Options is the options set for the dnstrack instance.
@@ -16,12 +17,155 @@ type Options struct {
 	// A/AAAA/CNAME/NS/PTR/...
 	Type string
 
+	// Status specifies the dns response status, optional:
+	// Success/FormatError/ServerFailure/NameError/...
+	// the queries and timeouts are displayed regardless of it
+	Status string
+
+	// Ports specifies the ports that the dns servers listen on
+	Ports []int
+
+	// BPFFilter specifies the extra bpf expression ANDed with the generated one,
+	// it applies to the vlan tagged frames as well
+	BPFFilter string
+
+	// Multicast specifies whether to track the mDNS(5353) and LLMNR(5355)
+	// messages as standalone events, the ports are merged into Ports whose
+	// messages are still tracked as the dns transactions
+	Multicast bool
+
+	// Mode specifies what to display, optional:
+	// - response: the transactions once answered
+	// - query: the queries as soon as they're seen
+	// - both: the queries and responses as events linked by the transaction id
+	Mode string
+
+	// Timeout specifies how long to wait for the responses before the queries
+	// are reported as timeouts, 0 disables it. The queries are still matched
+	// with the late responses until CacheTTL
+	Timeout time.Duration
+
+	// CacheSize specifies the capacity of the in-flight queries, the oldest
+	// ones are evicted once it's full
+	CacheSize int
+
+	// CacheTTL specifies how long the in-flight queries are kept without the
+	// responses, 0 keeps them until evicted. It must be longer than Timeout
+	CacheTTL time.Duration
+
+	// CrossDevice specifies whether to match the responses with the queries
+	// captured on the other devices, e.g. with the asymmetric routing. The
+	// copies of a packet captured on several devices are counted once and the
+	// unmatched responses are held shortly for the queries captured late
+	CrossDevice bool
+
+	// DuplicateWindow specifies how long the transactions are kept after the
+	// first responses to flag the extra ones, 0 disables it
+	DuplicateWindow time.Duration
+
+	// Correlate specifies whether to link the transactions of the same lookup
+	// across the stub, cache and upstream hops with a correlation id, a hop is
+	// linked if it's sent by the resolver of another hop
+	Correlate bool
+
+	// Collapse specifies whether to display one event per lookup with the
+	// end-to-end, upstream and local latency instead of the hops, correlation
+	// is implied
+	Collapse bool
+
+	// Process specifies whether to attribute the queries to the local processes
+	// through procfs of all the network namespaces, the packets read from
+	// files aren't attributed (linux only)
+	Process bool
+
+	// Cgroup specifies the cgroup path of the query processes to track along
+	// with its descendants, the other workloads aren't counted either, process
+	// attribution is implied
+	Cgroup string
+
+	// Container specifies the container id (prefix) of the query processes to
+	// track, the other workloads aren't counted either, process attribution is
+	// implied
+	Container string
+
 	// Devices represents devices regexp pattern to monitor
 	Devices string
 
-	// AllDevices specifies whether to listen all devices or not
+	// AllDevices specifies whether to listen all devices or not, the "any"
+	// pseudo device is excluded unless matched by Devices
 	AllDevices bool
 
+	// Netns specifies the network namespaces to capture in instead of the
+	// current one, given as paths, pids or names created by `ip netns add`.
+	// The devices are labelled with the namespace, e.g. <netns>/eth0 (linux only)
+	Netns []string
+
+	// Fanout specifies the number of AF_PACKET sockets per device which are
+	// joined into a fanout group and read concurrently (linux only)
+	Fanout int
+
+	// FrameSize specifies the TPACKET_V3 frame size in bytes (linux only)
+	FrameSize int
+
+	// BlockSize specifies the TPACKET_V3 block size in KB, it must be a multiple
+	// of the page size and FrameSize (linux only)
+	BlockSize int
+
+	// RingSize specifies the ring buffer size of each socket in MB (linux only)
+	RingSize int
+
+	// PollTimeout specifies how long the read blocks before waking up when the
+	// device is idle
+	PollTimeout time.Duration
+
+	// WatchInterval specifies how often the devices are polled if the link
+	// events are unavailable, 0 disables attaching the devices after startup
+	WatchInterval time.Duration
+
+	// Timestamp specifies the source of packet timestamps, optional:
+	// - kernel
+	// - hardware (fallback to kernel if the NIC doesn't support), the stamps
+	//   come from the clock of the NIC which isn't necessarily synced to UTC
+	Timestamp string
+
+	// ReadFile specifies the pcap/pcapng file to read packets from instead of
+	// capturing on the live devices
+	ReadFile string
+
+	// Write specifies the pcap/pcapng file to save the captured packets, the
+	// format is decided by the file extension. The pcap file holds the frames
+	// of a single link type, writing fails on the others
+	Write string
+
+	// WriteSize rotates the written file once its size exceeds in MB
+	WriteSize int
+
+	// WriteInterval rotates the written file periodically
+	WriteInterval time.Duration
+
+	// WriteMatched specifies whether to save the transactions that pass the
+	// filters only
+	WriteMatched bool
+
+	// Workers specifies the number of decoder workers, 0 means the number of
+	// CPUs
+	Workers int
+
+	// DecodeQueue specifies the capacity of the queue shared by the decoder
+	// workers
+	DecodeQueue int
+
+	// DecodePolicy specifies the backpressure policy once the decode queue is
+	// full, optional: block/drop-oldest/drop-newest
+	DecodePolicy string
+
+	// OutputQueue specifies the capacity of the output queue
+	OutputQueue int
+
+	// OutputPolicy specifies the backpressure policy once the output queue is
+	// full, optional: block/drop-oldest/drop-newest
+	OutputPolicy string
+
 	// Format decides to output format, optional:
 	// - json/j
 	// - yaml/y
@@ -32,8 +176,25 @@ type Options struct {
 
 func DefaultOptions() Options {
 	return Options{
-		AllDevices: true,
-		Format:     "verbose",
+		Ports:           []int{53},
+		AllDevices:      true,
+		Mode:            "response",
+		Timeout:         5 * time.Second,
+		DuplicateWindow: 2 * time.Second,
+		CacheSize:       65535,
+		CacheTTL:        30 * time.Second,
+		Fanout:          1,
+		FrameSize:       4096,
+		BlockSize:       512,
+		RingSize:        64,
+		PollTimeout:     100 * time.Millisecond,
+		Timestamp:       "kernel",
+		WatchInterval:   5 * time.Second,
+		DecodeQueue:     65536,
+		DecodePolicy:    "block",
+		OutputQueue:     4096,
+		OutputPolicy:    "block",
+		Format:          "verbose",
 	}
 }
 
@@ -57,11 +218,56 @@ func NewDnsTrack(opts Options) (*DnsTrack, error) {
 func (dt *DnsTrack) Start() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
-	<-sigCh
+	select {
+	case <-sigCh:
+	case <-dt.pcapClient.Done():
+	}
 }
 
+// Close stops the tracking and prints the summary once the captured messages
+// are drained.
 func (dt *DnsTrack) Close() {
-	stats := dt.pcapClient.Stats()
-	fmt.Fprintf(os.Stderr, "\n%d queries captured\n%d queries dropped by filter\n%d queries no response\n", stats.Queries, stats.Drop, stats.Missing)
 	dt.pcapClient.Close()
+	stats := dt.pcapClient.Stats()
+	if dt.opts.Multicast {
+		fmt.Fprintf(os.Stderr, "\n%d events captured\n%d events dropped by filter\n", stats.Events, stats.EventsDrop)
+	}
+	if !dt.opts.Multicast || len(dt.opts.Ports) > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d queries captured\n%d queries dropped by filter\n%d queries no response\n%d responses mismatched\n%d responses unmatched\n",
+			stats.Queries, stats.Drop, stats.Missing, stats.Mismatched, stats.Unmatched)
+		if dt.opts.Timeout > 0 {
+			fmt.Fprintf(os.Stderr, "%d queries timed out\n", stats.Timeouts)
+		}
+		if dt.opts.DuplicateWindow > 0 {
+			fmt.Fprintf(os.Stderr, "%d duplicate responses\n", stats.Duplicates)
+		}
+		fmt.Fprintf(os.Stderr, "%d queries expired\n%d queries evicted\n", stats.Expired, stats.Evicted)
+	}
+	if len(stats.Devices) > 0 {
+		fmt.Fprintln(os.Stderr, "\npackets by device:")
+		for _, d := range stats.Devices {
+			fmt.Fprintf(os.Stderr, "%s: %d received, %d dropped\n", d.Device, d.Received, d.Dropped)
+		}
+	}
+	var retried bool
+	for _, s := range stats.Servers {
+		if s.Retries == 0 {
+			break
+		}
+		if !retried {
+			fmt.Fprintln(os.Stderr, "\nretries by server:")
+			retried = true
+		}
+		fmt.Fprintf(os.Stderr, "%8d  %s (%d queries)\n", s.Retries, s.Server, s.Queries)
+	}
+	if len(stats.Workloads) > 0 {
+		fmt.Fprintln(os.Stderr, "\nqueries by workload:")
+		for _, w := range stats.Workloads {
+			fmt.Fprintf(os.Stderr, "%8d  %s\n", w.Queries, w.Key)
+		}
+	}
+
+	p := stats.Pipeline
+	fmt.Fprintf(os.Stderr, "\npipeline: %d enqueued, %d dropped by decode queue, %d decoded, %d formatted, %d dropped by output queue, %d written\n",
+		p.Enqueued, p.DecodeDropped, p.Decoded, p.Formatted, p.OutputDropped, p.Written)
 }
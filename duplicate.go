@@ -0,0 +1,225 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenjiandongx/dnstrack/codec"
+	"github.com/chenjiandongx/dnstrack/formatter"
+)
+
+// dupKey identifies the answered transactions, the server is left out since
+// the extra responses may come from other addresses.
+type dupKey struct {
+	device    string
+	transport string
+	client    netip.AddrPort
+	id        uint16
+	question  txQuestion
+}
+
+// answered is the first response of the transaction kept for the duplicate
+// window.
+type answered struct {
+	key     dupKey
+	when    time.Time
+	queried time.Time
+	src     netip.AddrPort
+	records []string
+	ttls    []uint32
+
+	txid        uint64
+	correlation uint64
+	process     *formatter.Process
+}
+
+// dupTable holds the answered transactions within the duplicate window in the
+// order of the answers.
+type dupTable struct {
+	mu      sync.Mutex
+	size    int
+	entries map[dupKey]*list.Element
+	order   *list.List
+}
+
+func newDupTable(size int) *dupTable {
+	return &dupTable{
+		size:    size,
+		entries: make(map[dupKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (t *dupTable) add(a *answered) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if elem, ok := t.entries[a.key]; ok {
+		t.order.Remove(elem)
+	}
+	if t.order.Len() >= t.size {
+		front := t.order.Front()
+		delete(t.entries, front.Value.(*answered).key)
+		t.order.Remove(front)
+	}
+	t.entries[a.key] = t.order.PushBack(a)
+}
+
+func (t *dupTable) get(k dupKey) (*answered, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elem, ok := t.entries[k]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*answered), true
+}
+
+// expire removes the transactions answered window or longer before now.
+func (t *dupTable) expire(now time.Time, window time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for elem := t.order.Front(); elem != nil; elem = t.order.Front() {
+		a := elem.Value.(*answered)
+		if now.Sub(a.when) < window {
+			break
+		}
+		delete(t.entries, a.key)
+		t.order.Remove(elem)
+	}
+}
+
+// copyWindow is how long the copies of a packet captured on the other devices
+// are dropped, e.g. the packets crossing a bridge and a veth.
+const copyWindow = 50 * time.Millisecond
+
+// copyKey identifies the packets by the addresses and the hash of the payload.
+type copyKey struct {
+	transport string
+	src       netip.AddrPort
+	dst       netip.AddrPort
+	sum       uint64
+}
+
+type copySeen struct {
+	key    copyKey
+	device string
+	when   time.Time
+}
+
+// copyTable holds the packets seen within the copy window in the order of
+// arrival, it's used if matching across the devices.
+type copyTable struct {
+	mu      sync.Mutex
+	size    int
+	entries map[copyKey]*list.Element
+	order   *list.List
+}
+
+func newCopyTable(size int) *copyTable {
+	return &copyTable{
+		size:    size,
+		entries: make(map[copyKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// seen reports whether the packet is a copy of the one captured on another
+// device within the copy window, the packets seen again on the same device are
+// the retransmissions instead.
+func (t *copyTable) seen(sp *SP, device string, ts time.Time) bool {
+	h := fnv.New64a()
+	h.Write(sp.Payload)
+	k := copyKey{transport: sp.Transport, src: sp.Src, dst: sp.Dst, sum: h.Sum64()}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if elem, ok := t.entries[k]; ok {
+		s := elem.Value.(*copySeen)
+		d := ts.Sub(s.when)
+		if s.device != device && d < copyWindow && d > -copyWindow {
+			return true
+		}
+		t.order.Remove(elem)
+	}
+	if t.order.Len() >= t.size {
+		front := t.order.Front()
+		delete(t.entries, front.Value.(*copySeen).key)
+		t.order.Remove(front)
+	}
+	t.entries[k] = t.order.PushBack(&copySeen{key: k, device: device, when: ts})
+	return false
+}
+
+// expire removes the packets seen window or longer before now.
+func (t *copyTable) expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for elem := t.order.Front(); elem != nil; elem = t.order.Front() {
+		s := elem.Value.(*copySeen)
+		if now.Sub(s.when) < copyWindow {
+			break
+		}
+		delete(t.entries, s.key)
+		t.order.Remove(elem)
+	}
+}
+
+// summarizeAnswers returns the answer records sorted along with their TTLs.
+func summarizeAnswers(r *codec.Message) ([]string, []uint32) {
+	idx := make([]int, len(r.AnswerSec))
+	for i := range idx {
+		idx[i] = i
+	}
+	record := func(a codec.Answer) string {
+		return strings.Join([]string{a.Name, a.Type, a.Class, a.Record}, " ")
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return record(r.AnswerSec[idx[i]]) < record(r.AnswerSec[idx[j]])
+	})
+
+	records := make([]string, 0, len(idx))
+	ttls := make([]uint32, 0, len(idx))
+	for _, i := range idx {
+		records = append(records, record(r.AnswerSec[i]))
+		ttls = append(ttls, r.AnswerSec[i].TTL)
+	}
+	return records, ttls
+}
+
+// diff returns what the extra response differs from the first one in, the
+// TTLs are only compared if the answers are the same.
+func (a *answered) diff(src netip.AddrPort, records []string, ttls []uint32) []string {
+	var differs []string
+	if src != a.src {
+		differs = append(differs, "source")
+	}
+	if !equalSlice(records, a.records) {
+		return append(differs, "answers")
+	}
+	if !equalSlice(ttls, a.ttls) {
+		differs = append(differs, "ttl")
+	}
+	return differs
+}
+
+func equalSlice[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
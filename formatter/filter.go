@@ -1,24 +1,33 @@
 package formatter
 
+import "net"
+
 type Filter struct {
 	server string
 	typ    string
+	status string
 }
 
-func NewFilter(server, typ string) *Filter {
+func NewFilter(server, typ, status string) *Filter {
 	return &Filter{
 		server: server,
 		typ:    typ,
+		status: status,
 	}
 }
 
 func (f Filter) Pass(msg MessageWrap) bool {
-	if f.server == "" && f.typ == "" {
+	if f.server == "" && f.typ == "" && f.status == "" {
 		return true
 	}
 
 	if f.server != "" {
-		if msg.Server != f.server+":53" {
+		// the port is optional, e.g. 8.8.8.8 or 8.8.8.8:53
+		if _, _, err := net.SplitHostPort(f.server); err == nil {
+			if msg.Server != f.server {
+				return false
+			}
+		} else if host, _, _ := net.SplitHostPort(msg.Server); host != f.server {
 			return false
 		}
 	}
@@ -27,6 +36,12 @@ func (f Filter) Pass(msg MessageWrap) bool {
 			return false
 		}
 	}
+	// the queries carry no status, the timeouts included
+	if f.status != "" && msg.Msg.Header.Response {
+		if msg.Msg.Header.Status != f.status {
+			return false
+		}
+	}
 
 	return true
 }
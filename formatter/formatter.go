@@ -5,29 +5,65 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chenjiandongx/dnstrack/codec"
 )
 
 type MessageWrap struct {
-	When     time.Time      `json:"time" yaml:"time"`
-	Size     int            `json:"size" yaml:"size"`
-	Duration time.Duration  `json:"duration" yaml:"duration"`
-	Device   string         `json:"device" yaml:"device"`
-	Server   string         `json:"server" yaml:"server"`
-	Msg      *codec.Message `json:"message" yaml:"message"`
+	When        time.Time      `json:"time" yaml:"time"`
+	Size        int            `json:"size" yaml:"size"`
+	Duration    time.Duration  `json:"duration" yaml:"duration"`
+	Attempts    int            `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	Total       time.Duration  `json:"total,omitempty" yaml:"total,omitempty"`
+	Device      string         `json:"device" yaml:"device"`
+	Server      string         `json:"server" yaml:"server"`
+	Transport   string         `json:"transport" yaml:"transport"`
+	VLANs       []uint16       `json:"vlans,omitempty" yaml:"vlans,omitempty"`
+	Event       string         `json:"event,omitempty" yaml:"event,omitempty"`
+	Differs     []string       `json:"differs,omitempty" yaml:"differs,omitempty"`
+	TxID        uint64         `json:"txid,omitempty" yaml:"txid,omitempty"`
+	Correlation uint64         `json:"correlation,omitempty" yaml:"correlation,omitempty"`
+	Resolution  *Resolution    `json:"resolution,omitempty" yaml:"resolution,omitempty"`
+	Process     *Process       `json:"process,omitempty" yaml:"process,omitempty"`
+	Msg         *codec.Message `json:"message" yaml:"message"`
+}
+
+// Resolution is the end-to-end view of the lookup correlated across the hops.
+type Resolution struct {
+	Hops     int           `json:"hops" yaml:"hops"`
+	Upstream time.Duration `json:"upstream" yaml:"upstream"`
+	Local    time.Duration `json:"local" yaml:"local"`
+}
+
+// Process is the local process which sent the query.
+type Process struct {
+	PID         int    `json:"pid" yaml:"pid"`
+	Comm        string `json:"comm" yaml:"comm"`
+	Cgroup      string `json:"cgroup,omitempty" yaml:"cgroup,omitempty"`
+	ContainerID string `json:"container_id,omitempty" yaml:"container_id,omitempty"`
+	PodUID      string `json:"pod_uid,omitempty" yaml:"pod_uid,omitempty"`
+}
+
+func (p *Process) String() string {
+	if p.ContainerID != "" {
+		return fmt.Sprintf("%s[%d]@%s", p.Comm, p.PID, p.ContainerID[:12])
+	}
+	return fmt.Sprintf("%s[%d]", p.Comm, p.PID)
 }
 
 type Formatter interface {
 	Format(msg MessageWrap) (string, bool)
 }
 
-func New(format, server, typ string, n int) Formatter {
-	f := NewFilter(server, typ)
+// New creates the formatter, the iface width is shared with the client which
+// updates it as devices come and go.
+func New(format, server, typ, status string, iw *atomic.Int64) Formatter {
+	f := NewFilter(server, typ, status)
 	switch format {
 	case "question", "q":
-		return questionFormatter{f, n}
+		return questionFormatter{f, iw, &atomic.Int64{}}
 	case "json", "j":
 		return jsonFormatter{f}
 	case "yaml", "y":
@@ -62,15 +98,27 @@ func formatDuration(d time.Duration) string {
 	return s
 }
 
-func formatIface(s string, maxIfaceLen int) string {
-	n := maxIfaceLen - len(s)
+func formatIface(s string, width *atomic.Int64) string {
+	n := int(width.Load()) - len(s)
 	return pad(n) + s
 }
 
-func formatServer(s string) string {
+// formatServer pads the server to the widest one seen so far, the column starts
+// with the IPv4 width and grows once longer IPv6 addresses show up.
+func formatServer(s string, width *atomic.Int64) string {
 	const maxServerLen = 18 // 172.172.172.172:53
-	n := maxServerLen - len(s)
-	return pad(n) + s
+	n := int64(len(s))
+	w := width.Load()
+	for n > w && !width.CompareAndSwap(w, n) {
+		w = width.Load()
+	}
+	if w < n {
+		w = n
+	}
+	if w < maxServerLen {
+		w = maxServerLen
+	}
+	return pad(int(w-n)) + s
 }
 
 func formatType(s string) string {
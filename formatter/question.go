@@ -2,12 +2,16 @@ package formatter
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type questionFormatter struct {
-	f *Filter
-	n int
+	f  *Filter
+	iw *atomic.Int64
+	sw *atomic.Int64
 }
 
 var _ Formatter = (*questionFormatter)(nil)
@@ -18,13 +22,39 @@ func (qf questionFormatter) Format(msg MessageWrap) (string, bool) {
 	}
 
 	q := msg.Msg.QuestionSec
+	duration, name := formatDuration(msg.Duration), q.Name
+	if msg.Event != "" {
+		name = q.Name + "\t" + msg.Event
+		// the timeouts carry the time waited
+		if msg.Duration == 0 {
+			duration = pad(8) + "-"
+		}
+	}
+	if msg.Attempts > 1 {
+		name += fmt.Sprintf("\tattempts=%d total=%s", msg.Attempts, strings.TrimSpace(formatDuration(msg.Total)))
+	}
+	if len(msg.Differs) > 0 {
+		name += "\tdiffers=" + strings.Join(msg.Differs, ",")
+	}
+	if msg.TxID != 0 {
+		name += "\t#" + strconv.FormatUint(msg.TxID, 10)
+	}
+	if msg.Correlation != 0 {
+		name += "\tcorr=" + strconv.FormatUint(msg.Correlation, 10)
+	}
+	if r := msg.Resolution; r != nil {
+		name += fmt.Sprintf("\thops=%d upstream=%s local=%s", r.Hops, strings.TrimSpace(formatDuration(r.Upstream)), strings.TrimSpace(formatDuration(r.Local)))
+	}
+	if msg.Process != nil {
+		name += "\t" + msg.Process.String()
+	}
 	s := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s",
 		msg.When.Format(time.RFC3339),
-		formatIface(msg.Device, qf.n),
-		formatServer(msg.Server),
+		formatIface(msg.Device, qf.iw),
+		formatServer(msg.Server, qf.sw),
 		formatType(q.Type),
-		formatDuration(msg.Duration),
-		q.Name,
+		duration,
+		name,
 	)
 	return s, true
 }
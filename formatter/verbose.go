@@ -3,7 +3,11 @@ package formatter
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/chenjiandongx/dnstrack/codec"
 )
 
 type verboseFormatter struct {
@@ -23,12 +27,69 @@ func (vf verboseFormatter) Format(msg MessageWrap) (string, bool) {
 	header := msg.Msg.Header
 	buf.WriteString(fmt.Sprintf("; <%s>@%s, ID: %d, OpCpde: %s, Status: %s\n", msg.Device, msg.Server, header.ID, header.OpCode, header.Status))
 	buf.WriteString(fmt.Sprintf(";; When: %s\n", msg.When.Format(time.RFC3339)))
-	buf.WriteString(fmt.Sprintf(";; Query Time: %s\n", msg.Duration))
+	if msg.Event != "" {
+		buf.WriteString(fmt.Sprintf(";; Event: %s\n", msg.Event))
+	}
+	if msg.Attempts > 1 {
+		buf.WriteString(fmt.Sprintf(";; Attempts: %d, Total Time: %s\n", msg.Attempts, msg.Total))
+	}
+	if len(msg.Differs) > 0 {
+		buf.WriteString(fmt.Sprintf(";; Differs: %s\n", strings.Join(msg.Differs, ", ")))
+	}
+	if msg.TxID != 0 {
+		buf.WriteString(fmt.Sprintf(";; Transaction: %d\n", msg.TxID))
+	}
+	if msg.Correlation != 0 {
+		buf.WriteString(fmt.Sprintf(";; Correlation: %d\n", msg.Correlation))
+	}
+	if r := msg.Resolution; r != nil {
+		buf.WriteString(fmt.Sprintf(";; Resolution: %d hops, Upstream: %s, Local: %s\n", r.Hops, r.Upstream, r.Local))
+	}
+	if msg.Event == "" || msg.Duration != 0 {
+		buf.WriteString(fmt.Sprintf(";; Query Time: %s\n", msg.Duration))
+	}
 	buf.WriteString(fmt.Sprintf(";; Msg Size: %dB\n", msg.Size))
+	buf.WriteString(fmt.Sprintf(";; Transport: %s\n", msg.Transport))
+	if msg.Process != nil {
+		p := msg.Process
+		buf.WriteString(fmt.Sprintf(";; Process: %s[%d]\n", p.Comm, p.PID))
+		if p.Cgroup != "" {
+			buf.WriteString(fmt.Sprintf(";; Cgroup: %s\n", p.Cgroup))
+		}
+		if p.ContainerID != "" {
+			buf.WriteString(fmt.Sprintf(";; Container: %s\n", p.ContainerID))
+		}
+		if p.PodUID != "" {
+			buf.WriteString(fmt.Sprintf(";; Pod: %s\n", p.PodUID))
+		}
+	}
+	if len(msg.VLANs) > 0 {
+		vlans := make([]string, 0, len(msg.VLANs))
+		for _, vlan := range msg.VLANs {
+			vlans = append(vlans, strconv.Itoa(int(vlan)))
+		}
+		buf.WriteString(fmt.Sprintf(";; VLAN: %s\n", strings.Join(vlans, "/")))
+	}
+
+	if opt := msg.Msg.OPT; opt != nil {
+		buf.WriteString("\n;; OPT Pseudosection:\n")
+		flags := ""
+		if opt.DO {
+			flags = " do"
+		}
+		buf.WriteString(fmt.Sprintf("; EDNS: version: %d, flags:%s; udp: %d\n", opt.Version, flags, opt.UDPSize))
+		for _, o := range opt.Options {
+			buf.WriteString(fmt.Sprintf("; %s: %s\n", o.Name, formatOption(o)))
+		}
+	}
 
 	question := msg.Msg.QuestionSec
 	buf.WriteString("\n;; Question Section:\n")
-	buf.WriteString(fmt.Sprintf("%s\t %s\n", question.Name, question.Type))
+	if question.Unicast {
+		buf.WriteString(fmt.Sprintf("%s\t %s\t QU\n", question.Name, question.Type))
+	} else {
+		buf.WriteString(fmt.Sprintf("%s\t %s\n", question.Name, question.Type))
+	}
 
 	answer := msg.Msg.AnswerSec
 	if len(answer) <= 0 {
@@ -36,7 +97,7 @@ func (vf verboseFormatter) Format(msg MessageWrap) (string, bool) {
 	} else {
 		buf.WriteString("\n;; Answer Section:\n")
 		for _, item := range answer {
-			buf.WriteString(fmt.Sprintf("%s\t %d\t %s\t %s\t %s\n", item.Name, item.TTL, item.Type, item.Class, item.Record))
+			buf.WriteString(fmt.Sprintf("%s\t %d\t %s\t %s\t %s%s\n", item.Name, item.TTL, item.Type, item.Class, item.Record, cacheFlush(item.CacheFlush)))
 		}
 	}
 
@@ -46,7 +107,7 @@ func (vf verboseFormatter) Format(msg MessageWrap) (string, bool) {
 	} else {
 		buf.WriteString("\n;; Authority Section:\n")
 		for _, item := range authority {
-			buf.WriteString(fmt.Sprintf("%s\t %s\t %s\t %s\n", item.Name, item.Type, item.Class, item.Record))
+			buf.WriteString(fmt.Sprintf("%s\t %s\t %s\t %s%s\n", item.Name, item.Type, item.Class, item.Record, cacheFlush(item.CacheFlush)))
 		}
 	}
 
@@ -56,9 +117,43 @@ func (vf verboseFormatter) Format(msg MessageWrap) (string, bool) {
 	} else {
 		buf.WriteString("\n;; Additional Section:\n")
 		for _, item := range additional {
-			buf.WriteString(fmt.Sprintf("%s\t %s\t %s\t %s\n", item.Name, item.Type, item.Class, item.Record))
+			buf.WriteString(fmt.Sprintf("%s\t %s\t %s\t %s%s\n", item.Name, item.Type, item.Class, item.Record, cacheFlush(item.CacheFlush)))
 		}
 	}
 
 	return buf.String(), true
 }
+
+func cacheFlush(b bool) string {
+	if b {
+		return "\t cache-flush"
+	}
+	return ""
+}
+
+// formatOption formats the EDNS option in the way of dig
+func formatOption(o codec.EDNSOption) string {
+	switch {
+	case o.ClientSubnet != nil:
+		return fmt.Sprintf("%s/%d", o.ClientSubnet.Address, o.ClientSubnet.ScopePrefix)
+	case o.Cookie != nil:
+		return o.Cookie.Client + o.Cookie.Server
+	case o.Keepalive != nil:
+		if o.Keepalive.Timeout == 0 {
+			return "-"
+		}
+		return o.Keepalive.Timeout.String()
+	case o.ExtendedError != nil:
+		e := o.ExtendedError
+		s := fmt.Sprintf("%d (%s)", e.InfoCode, e.Info)
+		if e.ExtraText != "" {
+			s += fmt.Sprintf(": %q", e.ExtraText)
+		}
+		return s
+	case o.NSID != "":
+		return o.NSID
+	case o.Name == "PADDING":
+		return fmt.Sprintf("%d bytes", o.Padding)
+	}
+	return o.Data
+}
@@ -30,6 +30,11 @@ func NewApp() *cobra.Command {
 				return
 			}
 
+			// the default ports are only tracked along with the multicast ones
+			// if asked explicitly
+			if opt.Multicast && !cmd.Flags().Changed("ports") {
+				opt.Ports = nil
+			}
 			dq, err := NewDnsTrack(opt)
 			if err != nil {
 				exit(err)
@@ -41,7 +46,49 @@ func NewApp() *cobra.Command {
   $ dnstrack -l
 
   # filters google dns server packet attached in lo0 dev and output with json format
-  $ dnstrack -s 8.8.8.8 -o j -d '^lo0$'`,
+  $ dnstrack -s 8.8.8.8 -o j -d '^lo0$'
+
+  # track the dns servers listening on 53 and 5353 port while ignoring the local ones
+  $ dnstrack -p 53,5353 -f 'not host 127.0.0.1'
+
+  # watch the service discovery announcements and queries
+  $ dnstrack -m -o q
+
+  # watch the service discovery along with the lookups on port 53
+  $ dnstrack -m -p 53 -o q
+
+  # find out which processes are making the lookups
+  $ dnstrack --process -o q
+
+  # track the lookups of a single container
+  $ dnstrack --container 3f4e1a2b9c8d -o q
+
+  # capture in the namespaces of a pod process and a named netns
+  $ dnstrack -n 12345,blue -o q
+
+  # spread the capture of a busy resolver across 4 sockets with larger rings
+  $ dnstrack -d eth0 --fanout 4 --ring-size 256
+
+  # report the queries unanswered for 2 seconds
+  $ dnstrack -o q --timeout 2s
+
+  # print the queries as soon as they're seen, e.g. on mirrored egress traffic
+  $ dnstrack -o q --mode query
+
+  # match the transactions routed asymmetrically through eth0 and eth1
+  $ dnstrack -d 'eth[01]' --cross-device
+
+  # tell the latency added by the local stub resolver from the upstream one
+  $ dnstrack -o q --collapse
+
+  # never let a slow terminal stall the capture
+  $ dnstrack --output-policy drop-oldest
+
+  # analyze the packets saved by tcpdump with question format
+  $ dnstrack -r capture.pcapng -o q
+
+  # save the ServerFailure transactions to pcapng files rotated every 100MB
+  $ dnstrack -o q --status ServerFailure -w dns.pcapng --write-size 100 --write-matched`,
 	}
 
 	app.Flags().BoolVarP(&list, "list", "l", false, "list all devices name")
@@ -49,6 +96,39 @@ func NewApp() *cobra.Command {
 	app.Flags().BoolVarP(&opt.AllDevices, "all-devices", "a", defaultOpts.AllDevices, "listen all devices if present")
 	app.Flags().StringVarP(&opt.Server, "server", "s", defaultOpts.Server, "dns server filter")
 	app.Flags().StringVarP(&opt.Type, "type", "t", defaultOpts.Type, "dns query type filter [A/AAAA/CNAME/...]")
+	app.Flags().IntSliceVarP(&opt.Ports, "ports", "p", defaultOpts.Ports, "dns server ports")
+	app.Flags().StringVarP(&opt.BPFFilter, "bpf-filter", "f", defaultOpts.BPFFilter, "extra bpf expression ANDed with the generated one")
+	app.Flags().BoolVarP(&opt.Multicast, "multicast", "m", defaultOpts.Multicast, "track mDNS/LLMNR messages as standalone events, the transactions on the ports given by -p are still tracked")
+	app.Flags().StringVar(&opt.Mode, "mode", defaultOpts.Mode, "messages to display [response|query|both]")
+	app.Flags().DurationVar(&opt.Timeout, "timeout", defaultOpts.Timeout, "report the queries unanswered for the duration as timeouts, 0 disables it")
+	app.Flags().IntVar(&opt.CacheSize, "cache-size", defaultOpts.CacheSize, "capacity of the in-flight queries")
+	app.Flags().DurationVar(&opt.CacheTTL, "cache-ttl", defaultOpts.CacheTTL, "lifetime of the in-flight queries without responses, longer than the timeout, 0 keeps them until evicted")
+	app.Flags().BoolVar(&opt.CrossDevice, "cross-device", defaultOpts.CrossDevice, "match the responses with the queries captured on the other devices")
+	app.Flags().DurationVar(&opt.DuplicateWindow, "duplicate-window", defaultOpts.DuplicateWindow, "flag the extra responses within the duration after the first one, 0 disables it")
+	app.Flags().BoolVar(&opt.Correlate, "correlate", defaultOpts.Correlate, "link the hops of the same lookup with a correlation id")
+	app.Flags().BoolVar(&opt.Collapse, "collapse", defaultOpts.Collapse, "display one event per lookup with the upstream and local latency")
+	app.Flags().BoolVar(&opt.Process, "process", defaultOpts.Process, "attribute queries to the local processes (linux only)")
+	app.Flags().StringVar(&opt.Cgroup, "cgroup", defaultOpts.Cgroup, "cgroup path filter of the query processes including the descendants (linux only)")
+	app.Flags().StringVar(&opt.Container, "container", defaultOpts.Container, "container id filter of the query processes (linux only)")
+	app.Flags().StringVar(&opt.Status, "status", defaultOpts.Status, "dns response status filter [Success/ServerFailure/NameError/...]")
+	app.Flags().StringSliceVarP(&opt.Netns, "netns", "n", defaultOpts.Netns, "network namespaces to capture in, given as paths, pids or names (linux only)")
+	app.Flags().IntVar(&opt.Fanout, "fanout", defaultOpts.Fanout, "number of AF_PACKET sockets per device in a fanout group (linux only)")
+	app.Flags().IntVar(&opt.FrameSize, "frame-size", defaultOpts.FrameSize, "TPACKET_V3 frame size in bytes (linux only)")
+	app.Flags().IntVar(&opt.BlockSize, "block-size", defaultOpts.BlockSize, "TPACKET_V3 block size in KB (linux only)")
+	app.Flags().IntVar(&opt.RingSize, "ring-size", defaultOpts.RingSize, "ring buffer size per socket in MB (linux only)")
+	app.Flags().DurationVar(&opt.PollTimeout, "poll-timeout", defaultOpts.PollTimeout, "poll timeout when the device is idle")
+	app.Flags().DurationVar(&opt.WatchInterval, "watch-interval", defaultOpts.WatchInterval, "devices polling interval if link events are unavailable, 0 disables watching")
+	app.Flags().StringVar(&opt.Timestamp, "timestamp", defaultOpts.Timestamp, "packet timestamp source [kernel|hardware]")
+	app.Flags().IntVar(&opt.Workers, "workers", defaultOpts.Workers, "number of decoder workers, 0 for the number of CPUs")
+	app.Flags().IntVar(&opt.DecodeQueue, "decode-queue", defaultOpts.DecodeQueue, "capacity of the decode queue")
+	app.Flags().StringVar(&opt.DecodePolicy, "decode-policy", defaultOpts.DecodePolicy, "policy once the decode queue is full [block|drop-oldest|drop-newest]")
+	app.Flags().IntVar(&opt.OutputQueue, "output-queue", defaultOpts.OutputQueue, "capacity of the output queue")
+	app.Flags().StringVar(&opt.OutputPolicy, "output-policy", defaultOpts.OutputPolicy, "policy once the output queue is full [block|drop-oldest|drop-newest]")
+	app.Flags().StringVarP(&opt.ReadFile, "read-file", "r", defaultOpts.ReadFile, "read packets from pcap/pcapng file instead of devices")
+	app.Flags().StringVarP(&opt.Write, "write", "w", defaultOpts.Write, "write packets to pcap/pcapng file decided by the extension")
+	app.Flags().IntVar(&opt.WriteSize, "write-size", defaultOpts.WriteSize, "rotate the written file once it exceeds the size in MB")
+	app.Flags().DurationVar(&opt.WriteInterval, "write-interval", defaultOpts.WriteInterval, "rotate the written file periodically")
+	app.Flags().BoolVar(&opt.WriteMatched, "write-matched", defaultOpts.WriteMatched, "only write the transactions that pass the filters")
 	app.Flags().StringVarP(&opt.Format, "output-format", "o", defaultOpts.Format, "output format [json(j)|yaml(y)|question(q)|verbose(v)]")
 
 	app.Flags().PrintDefaults()
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// netnsPidPath matches the namespace path of a process, e.g. /proc/1234/ns/net
+var netnsPidPath = regexp.MustCompile(`^/proc/(\d+)/ns/net$`)
+
+// netns is the network namespace to capture in, the zero value stands for the
+// one dnstrack runs in.
+type netns struct {
+	label string
+	path  string
+}
+
+// device returns the device name labelled with the namespace.
+func (ns netns) device(name string) string {
+	if ns.label == "" {
+		return name
+	}
+	return ns.label + "/" + name
+}
+
+// parseNetns resolves the namespaces given as paths, pids or the names created
+// by `ip netns add`, the current one is used if none is given.
+func parseNetns(specs []string) ([]netns, error) {
+	if len(specs) == 0 {
+		return []netns{{}}, nil
+	}
+
+	var r []netns
+	for _, spec := range specs {
+		var ns netns
+		switch {
+		case strings.Contains(spec, "/"):
+			ns.path, ns.label = spec, filepath.Base(spec)
+			if m := netnsPidPath.FindStringSubmatch(spec); m != nil {
+				ns.label = m[1]
+			}
+
+		case isPid(spec):
+			ns.path, ns.label = filepath.Join("/proc", spec, "ns/net"), spec
+
+		default:
+			ns.path, ns.label = filepath.Join("/var/run/netns", spec), spec
+		}
+
+		if _, err := os.Stat(ns.path); err != nil {
+			return nil, errors.Wrapf(err, "invalid netns(%s)", spec)
+		}
+		r = append(r, ns)
+	}
+	return r, nil
+}
+
+func isPid(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0
+}
+
+// nsDevice is the device matched in the namespace, the index tells the device
+// recreated with the same name apart, it's 0 if unknown.
+type nsDevice struct {
+	ns    netns
+	name  string
+	index int
+}
+
+// listDevices lists the devices matched in the namespace.
+func (c *PcapClient) listDevices(ns netns) ([]nsDevice, error) {
+	var devs []nsDevice
+	err := inNetns(ns, func() error {
+		matched, err := filterDevices(c.opt.Devices, c.opt.AllDevices)
+		if err != nil {
+			return err
+		}
+		indexes := make(map[string]int)
+		if ifaces, err := net.Interfaces(); err == nil {
+			for _, iface := range ifaces {
+				indexes[iface.Name] = iface.Index
+			}
+		}
+		for _, device := range matched {
+			devs = append(devs, nsDevice{ns: ns, name: device.Name, index: indexes[device.Name]})
+		}
+		return nil
+	})
+	return devs, err
+}
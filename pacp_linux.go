@@ -5,81 +5,477 @@ package main
 import (
 	"context"
 	"fmt"
-	"time"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/afpacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/pkg/errors"
 	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
 
 	"github.com/chenjiandongx/dnstrack/formatter"
 )
 
 type pcapHandler struct {
-	device string
-	handle *afpacket.TPacket
+	device   string
+	linkType dlt
+	handle   *afpacket.TPacket
+	parser   *parser
+
+	// restore puts the hardware timestamping config of the device back, it's
+	// set on the first handler of the device
+	restore func() error
 }
 
 type PcapClient struct {
-	ctx         context.Context
-	cancel      context.CancelFunc
-	opt         Options
-	handlers    []*pcapHandler
-	common      *CommonClient
-	maxIfaceLen int
+	ctx        context.Context
+	cancel     context.CancelFunc
+	opt        Options
+	ports      dnsPorts
+	file       *pcap.Handle
+	done       chan struct{}
+	common     *CommonClient
+	ifaceWidth *atomic.Int64
+	netns      []netns
+
+	watchWg sync.WaitGroup
+	mu      sync.Mutex
+	devices map[string]*attachedDevice
+	// skipped are the indexes of the devices which can't be captured
+	skipped     map[string]int
+	detached    map[string]DeviceStats
+	fanoutGroup int
 }
 
 func NewPcapClient(opt Options) (*PcapClient, error) {
-	client := &PcapClient{opt: opt}
-	client.ctx, client.cancel = context.WithCancel(context.Background())
-	if err := client.getAvailableDevices(); err != nil {
+	if opt.Multicast {
+		opt.Ports = withMulticastPorts(opt.Ports)
+	}
+	// the workloads are told by the processes
+	if opt.Cgroup != "" || opt.Container != "" {
+		opt.Process = true
+	}
+	ports, err := newDNSPorts(opt.Ports)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTimestamp(opt.Timestamp); err != nil {
+		return nil, err
+	}
+	if err := checkRing(opt); err != nil {
 		return nil, err
 	}
+	copt, err := newCommonOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	// listeners wake up periodically to notice the detachment
+	if opt.PollTimeout <= 0 {
+		return nil, errors.Errorf("invalid poll timeout(%s)", opt.PollTimeout)
+	}
+	namespaces, err := parseNetns(opt.Netns)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &PcapClient{
+		opt:        opt,
+		ports:      ports,
+		done:       make(chan struct{}),
+		ifaceWidth: &atomic.Int64{},
+		netns:      namespaces,
+		devices:    make(map[string]*attachedDevice),
+		skipped:    make(map[string]int),
+		detached:   make(map[string]DeviceStats),
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	client.common = NewCommonClient(formatter.New(opt.Format, opt.Server, opt.Type, opt.Status, client.ifaceWidth), newPcapWriter(opt), copt)
 
-	client.common = NewCommonClient(formatter.New(opt.Format, opt.Server, opt.Type, client.maxIfaceLen))
-	for _, handler := range client.handlers {
-		go client.listen(handler)
+	if opt.ReadFile != "" {
+		linkType, err := client.openFile()
+		if err != nil {
+			return nil, err
+		}
+		device := filepath.Base(opt.ReadFile)
+		go client.readFile(&pcapHandler{
+			device:   device,
+			linkType: linkType,
+			parser:   newParser(client.common, device, linkType, client.ports, opt.Multicast, 0),
+		})
+		return client, nil
 	}
 
+	if err := client.getAvailableDevices(); err != nil {
+		return nil, err
+	}
+	if opt.WatchInterval > 0 {
+		client.startWatcher()
+	}
 	return client, nil
 }
 
-func (c *PcapClient) getAvailableDevices() error {
-	devs, err := filterDevices(c.opt.Devices, c.opt.AllDevices)
+// openDevice opens the sockets on the device in the namespace which are joined
+// into a fanout group if more than one is required.
+func (c *PcapClient) openDevice(ns netns, name string) ([]*pcapHandler, error) {
+	device := ns.device(name)
+	c.fanoutGroup++
+
+	var handlers []*pcapHandler
+	err := inNetns(ns, func() error {
+		// skip the devices gone or which aren't network interfaces
+		linkType, cooked, err := deviceLinkType(name)
+		if err != nil {
+			return nil
+		}
+
+		var hardware bool
+		for i := 0; i < c.fanout(); i++ {
+			handler, err := c.getHandler(name, cooked)
+			if err != nil {
+				return errors.Wrapf(err, "get device(%s) name failed", device)
+			}
+			ph := &pcapHandler{device: device, linkType: linkType, handle: handler}
+			handlers = append(handlers, ph)
+
+			// the config is shared by all the sockets on the device
+			if i == 0 && c.opt.Timestamp == timestampHardware {
+				restore, err := enableHardwareTimestamp(name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Enable hardware timestamps on device(%s) failed: %v, fallback to kernel ones\n", device, err)
+				} else {
+					hardware = true
+					ph.restore = func() error { return inNetns(ns, restore) }
+				}
+			}
+			if hardware {
+				if err = useHardwareTimestamp(handler); err != nil {
+					return errors.Wrapf(err, "use hardware timestamps on device(%s) failed", device)
+				}
+			}
+
+			if err = c.setBPFFilter(handler, linkType); err != nil {
+				return errors.Wrapf(err, "set bpf-filter on device(%s) failed", device)
+			}
+			// the packets counted before the filter are not the concern
+			if err = handler.InitSocketStats(); err != nil {
+				return errors.Wrapf(err, "init socket stats on device(%s) failed", device)
+			}
+			if c.fanout() > 1 {
+				if err = handler.SetFanout(afpacket.FanoutHashWithDefrag, fanoutGroupID(c.fanoutGroup)); err != nil {
+					return errors.Wrapf(err, "join fanout group on device(%s) failed", device)
+				}
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		for _, h := range handlers {
+			h.close()
+		}
+		return nil, err
 	}
 
-	for _, device := range devs {
-		handler, err := c.getHandler(device.Name)
+	return handlers, nil
+}
+
+// inNetns runs fn in the network namespace, the sockets created by fn stay in
+// there. fn runs on a dedicated thread which is discarded if the namespace of it
+// can't be restored.
+func inNetns(ns netns, fn func() error) error {
+	if ns.path == "" {
+		return fn()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
 		if err != nil {
-			return errors.Wrapf(err, "get device(%s) name failed", device.Name)
+			runtime.UnlockOSThread()
+			errCh <- errors.Wrap(err, "open current netns failed")
+			return
 		}
+		defer origin.Close()
 
-		if err = c.setBPFFilter(handler, bpfFilter); err != nil {
-			return errors.Wrapf(err, "set bpf-filter on device(%s) failed", device.Name)
+		target, err := os.Open(ns.path)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- errors.Wrapf(err, "open netns(%s) failed", ns.path)
+			return
 		}
+		defer target.Close()
 
-		if c.maxIfaceLen < len(device.Name) {
-			c.maxIfaceLen = len(device.Name)
+		if err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- errors.Wrapf(err, "enter netns(%s) failed", ns.path)
+			return
 		}
-		c.handlers = append(c.handlers, &pcapHandler{device: device.Name, handle: handler})
+
+		err = fn()
+		// leave the thread locked to let it exit with the goroutine
+		if unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+func (c *PcapClient) openFile() (dlt, error) {
+	handle, err := pcap.OpenOffline(c.opt.ReadFile)
+	if err != nil {
+		return 0, errors.Wrapf(err, "open file(%s) failed", c.opt.ReadFile)
+	}
+
+	linkType, ok := handleDLT(handle)
+	if !ok {
+		handle.Close()
+		return 0, errors.Errorf("unsupported link type(%s) of file(%s)", handle.LinkType(), c.opt.ReadFile)
+	}
+
+	if err = handle.SetBPFFilter(bpfFilter(linkType, c.opt.Ports, c.opt.BPFFilter)); err != nil {
+		handle.Close()
+		return 0, errors.Wrapf(err, "set bpf-filter on file(%s) failed", c.opt.ReadFile)
+	}
+
+	c.file = handle
+	c.ifaceWidth.Store(int64(len(filepath.Base(c.opt.ReadFile))))
+	return linkType, nil
+}
+
+func (c *PcapClient) fanout() int {
+	if c.opt.Fanout < 1 {
+		return 1
+	}
+	return c.opt.Fanout
+}
+
+// checkRing checks the sizes of the TPACKET_V3 ring, the block holds the whole
+// frames and is aligned to the pages.
+func checkRing(opt Options) error {
+	if opt.FrameSize <= 0 {
+		return errors.Errorf("invalid frame size(%d)", opt.FrameSize)
+	}
+	if opt.BlockSize <= 0 {
+		return errors.Errorf("invalid block size(%d)", opt.BlockSize)
+	}
+	if opt.RingSize <= 0 {
+		return errors.Errorf("invalid ring size(%d)", opt.RingSize)
+	}
+	blockSize := opt.BlockSize * 1024
+	if blockSize%os.Getpagesize() != 0 || blockSize%opt.FrameSize != 0 {
+		return errors.Errorf("invalid block size(%d), it must be a multiple of the page size(%d) and frame size(%d)",
+			opt.BlockSize, os.Getpagesize(), opt.FrameSize)
+	}
+	return nil
+}
+
+// fanoutGroupID returns the id of the n-th fanout group, ids are shared by all
+// processes in the network namespace so the pid is mixed in.
+func fanoutGroupID(n int) uint16 {
+	return uint16((os.Getpid() + n) & 0xffff)
+}
+
+// getHandler opens the socket on the device, the cooked one delivers the frames
+// with the link layer headers stripped. The socket of the "any" device is bound
+// to all the devices.
+func (c *PcapClient) getHandler(device string, cooked bool) (*afpacket.TPacket, error) {
+	blockSize := c.opt.BlockSize * 1024
+	numBlocks := c.opt.RingSize * 1024 * 1024 / blockSize
+	if numBlocks < 1 {
+		numBlocks = 1
+	}
+
+	socketType := afpacket.SocketRaw
+	if cooked {
+		socketType = afpacket.SocketDgram
+	}
+	if device == anyDevice {
+		device = ""
 	}
 
-	if len(c.handlers) == 0 {
-		return errors.New("no available devices found")
+	return afpacket.NewTPacket(
+		afpacket.OptInterface(device),
+		socketType,
+		afpacket.TPacketVersion3,
+		afpacket.OptFrameSize(c.opt.FrameSize),
+		afpacket.OptBlockSize(blockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		afpacket.OptPollTimeout(c.opt.PollTimeout),
+	)
+}
+
+// deviceLinkType tells how the frames captured by AF_PACKET socket begin in terms
+// of the ARPHRD type of the device, layer 3 devices like tun, wireguard and ppp
+// deliver the bare ip packets. The devices with other link layer headers and the
+// "any" device are captured through the cooked socket which delivers the bare ip
+// packets as well, it reports whether the cooked one is required. The type is
+// queried through a socket rather than sysfs which shows the devices of the
+// namespace it was mounted in.
+func deviceLinkType(device string) (dlt, bool, error) {
+	if device == anyDevice {
+		return dltRaw, true, nil
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq(device)
+	if err != nil {
+		return 0, false, err
+	}
+	if err = unix.IoctlIfreq(fd, unix.SIOCGIFHWADDR, ifr); err != nil {
+		return 0, false, err
+	}
+
+	// ifr_hwaddr.sa_family holds the ARPHRD type
+	switch ifr.Uint16() {
+	case unix.ARPHRD_ETHER, unix.ARPHRD_LOOPBACK:
+		return dltEthernet, false, nil
+	case unix.ARPHRD_NONE, unix.ARPHRD_PPP, unix.ARPHRD_RAWIP,
+		unix.ARPHRD_TUNNEL, unix.ARPHRD_TUNNEL6, unix.ARPHRD_SIT, unix.ARPHRD_IPGRE:
+		return dltRaw, false, nil
+	}
+	return dltRaw, true, nil
+}
+
+// hwtstampConfig is the struct hwtstamp_config of the hardware timestamping.
+type hwtstampConfig struct {
+	flags    int32
+	txType   int32
+	rxFilter int32
+}
+
+const hwtstampFilterAll = 1
+
+// hwtstamp issues the hardware timestamping ioctl on the device.
+func hwtstamp(device string, req uint, cfg *hwtstampConfig) error {
+	if len(device) >= unix.IFNAMSIZ {
+		return errors.Errorf("device name too long")
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var ifr struct {
+		name [unix.IFNAMSIZ]byte
+		data unsafe.Pointer
+		_    [16]byte
+	}
+	copy(ifr.name[:], device)
+	ifr.data = unsafe.Pointer(cfg)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
 	}
 	return nil
 }
 
-func (c *PcapClient) getHandler(device string) (*afpacket.TPacket, error) {
-	return afpacket.NewTPacket(afpacket.OptInterface(device))
+// enableHardwareTimestamp asks the NIC to stamp all the incoming packets, the
+// config replaced is restored by the returned function once the capturing ends
+// since it's shared by the whole system.
+func enableHardwareTimestamp(device string) (func() error, error) {
+	var saved hwtstampConfig
+	if err := hwtstamp(device, unix.SIOCGHWTSTAMP, &saved); err != nil {
+		return nil, errors.Wrap(err, "ioctl SIOCGHWTSTAMP")
+	}
+	if saved.rxFilter == hwtstampFilterAll {
+		return func() error { return nil }, nil
+	}
+
+	cfg := saved
+	cfg.rxFilter = hwtstampFilterAll
+	if err := hwtstamp(device, unix.SIOCSHWTSTAMP, &cfg); err != nil {
+		return nil, errors.Wrap(err, "ioctl SIOCSHWTSTAMP")
+	}
+	return func() error {
+		return hwtstamp(device, unix.SIOCSHWTSTAMP, &saved)
+	}, nil
 }
 
-func (c *PcapClient) setBPFFilter(h *afpacket.TPacket, filter string) error {
-	pcapBPF, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, filter)
+// useHardwareTimestamp asks the socket to report the raw hardware stamps in the
+// ring instead of the kernel ones.
+func useHardwareTimestamp(h *afpacket.TPacket) error {
+	fd, err := socketFd(h)
+	if err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_TIMESTAMP, unix.SOF_TIMESTAMPING_RAW_HARDWARE)
+}
+
+// socketFd finds the file descriptor of the socket which isn't exported by the
+// TPacket. A filter carrying a random marker is attached to the socket and looked
+// up among the sockets of the process, it drops all the packets until replaced.
+func socketFd(h *afpacket.TPacket) (int, error) {
+	marker, err := bpf.Assemble([]bpf.Instruction{
+		bpf.LoadConstant{Dst: bpf.RegA, Val: rand.Uint32()},
+		bpf.RetConstant{Val: 0},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = h.SetBPF(marker); err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		fd, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if filter := socketFilter(fd, len(marker)); filter != nil && sameFilter(filter, marker) {
+			return fd, nil
+		}
+	}
+	return 0, errors.New("socket not found")
+}
+
+func sameFilter(a, b []bpf.RawInstruction) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// socketFilter returns the classic bpf filter attached to the socket if it has
+// n instructions, the length of SO_GET_FILTER is counted in instructions.
+func socketFilter(fd int, n int) []bpf.RawInstruction {
+	filter := make([]bpf.RawInstruction, n)
+	size := uint32(n)
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_GET_FILTER,
+		uintptr(unsafe.Pointer(&filter[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 || int(size) != n {
+		return nil
+	}
+	return filter
+}
+
+func (c *PcapClient) setBPFFilter(h *afpacket.TPacket, linkType dlt) error {
+	lt, _ := linkType.layersType()
+	pcapBPF, err := pcap.CompileBPFFilter(lt, 65535, bpfFilter(linkType, c.opt.Ports, c.opt.BPFFilter))
 	if err != nil {
 		return err
 	}
@@ -95,78 +491,134 @@ func (c *PcapClient) setBPFFilter(h *afpacket.TPacket, filter string) error {
 	return h.SetBPF(bpfIns)
 }
 
-func (c *PcapClient) parsePacket(data []byte) *SP {
-	var ether layers.Ethernet
-	var err error
-	if err = ether.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
-		return nil
+// listen reads packets until the device is detached, the poll timeout wakes the
+// blocking read up periodically when the device is idle.
+func (c *PcapClient) listen(ctx context.Context, ph *pcapHandler) {
+	for ctx.Err() == nil {
+		pkt, ci, err := ph.handle.ZeroCopyReadPacketData()
+		if err != nil {
+			continue
+		}
+		c.common.Record(ph.device, ph.linkType, ci.Timestamp, pkt)
+		sp := ph.parser.parse(pkt, ci.Timestamp)
+		if sp == nil {
+			continue
+		}
+		sp.Frame, sp.LinkType = pkt, ph.linkType
+		sp.VLANs = ancillaryVLANs(ci, sp.VLANs)
+		c.common.Display(sp, ph.device, ci.Timestamp)
 	}
+}
 
-	switch ether.EthernetType {
-	case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
-	default:
-		return nil
+// close closes the socket, the hardware timestamping config of the device is
+// restored with the first one.
+func (ph *pcapHandler) close() {
+	ph.handle.Close()
+	if ph.restore != nil {
+		_ = ph.restore()
 	}
+}
 
-	var ipv4 layers.IPv4
-	if err = ipv4.DecodeFromBytes(ether.Payload, gopacket.NilDecodeFeedback); err != nil {
-		return nil
+// captureStats returns the packets received and dropped by the kernel since the
+// socket was opened, the received ones include the dropped ones.
+func (ph *pcapHandler) captureStats() (uint64, uint64) {
+	_, stats, err := ph.handle.SocketStats()
+	if err != nil {
+		return 0, 0
 	}
+	return uint64(stats.Packets()), uint64(stats.Drops())
+}
 
-	srcIP := ipv4.SrcIP.String()
-	dstIP := ipv4.DstIP.String()
-	var pkg layers.UDP
-	if err = pkg.DecodeFromBytes(ipv4.Payload, gopacket.NilDecodeFeedback); err != nil {
-		return nil
+// ancillaryVLANs prepends the vlan tag stripped by the kernel which is delivered
+// out-of-band to the ones left in the frame.
+func ancillaryVLANs(ci gopacket.CaptureInfo, vlans []uint16) []uint16 {
+	for _, data := range ci.AncillaryData {
+		if v, ok := data.(afpacket.AncillaryVLAN); ok {
+			return append([]uint16{uint16(v.VLAN)}, vlans...)
+		}
 	}
+	return vlans
+}
 
-	srcPort := uint16(pkg.SrcPort)
-	dstPort := uint16(pkg.DstPort)
-
-	var server string
-	if srcPort == dnsPort {
-		server = fmt.Sprintf("%s:%d", srcIP, srcPort)
-	} else {
-		server = fmt.Sprintf("%s:%d", dstIP, dstPort)
+// readFile decodes all packets of the offline file with their recorded timestamps
+// and closes the done channel once the file ends.
+func (c *PcapClient) readFile(ph *pcapHandler) {
+	defer close(c.done)
+	for c.ctx.Err() == nil {
+		pkt, ci, err := c.file.ZeroCopyReadPacketData()
+		if err != nil {
+			return
+		}
+		c.common.Record(ph.device, ph.linkType, ci.Timestamp, pkt)
+		sp := ph.parser.parse(pkt, ci.Timestamp)
+		if sp == nil {
+			continue
+		}
+		sp.Frame, sp.LinkType = pkt, ph.linkType
+		c.common.Display(sp, ph.device, ci.Timestamp)
 	}
+}
 
-	return &SP{
-		Server:  server,
-		Payload: pkg.Payload,
+// linkEvents notifies once the links are added, removed or changed through the
+// rtnetlink multicast group, the channel is closed if the socket fails.
+func linkEvents(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, errors.Wrap(err, "open netlink socket failed")
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "bind netlink socket failed")
+	}
+	// the receiving wakes up periodically to notice the cancellation
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "set netlink socket timeout failed")
 	}
-}
 
-func (c *PcapClient) listen(ph *pcapHandler) {
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		defer unix.Close(fd)
 
-			// decode packets followed by layers
-			// 1) Ethernet Layer
-			// 2) IP Layer
-			// 3) UDP Layer
-		default:
-			pkt, _, err := ph.handle.ZeroCopyReadPacketData()
-			if err != nil {
+		buf := make([]byte, os.Getpagesize())
+		for ctx.Err() == nil {
+			_, _, err := unix.Recvfrom(fd, buf, 0)
+			switch err {
+			case unix.EAGAIN, unix.EINTR:
 				continue
+			case nil, unix.ENOBUFS: // events may be lost on overflow, rescan anyway
+			default:
+				return
 			}
-			sp := c.parsePacket(pkt)
-			if sp == nil {
-				continue
+			select {
+			case ch <- struct{}{}:
+			default:
 			}
-			c.common.Display(sp, ph.device, time.Now()) // approximate time
 		}
-	}
+	}()
+	return ch, nil
+}
+
+// Done returns a channel that's closed when there are no more packets to read.
+func (c *PcapClient) Done() <-chan struct{} {
+	return c.done
 }
 
 func (c *PcapClient) Stats() Stats {
-	return c.common.Stats()
+	stats := c.common.Stats()
+	stats.Devices = c.deviceStats()
+	return stats
 }
 
+// Close stops capturing and drains the messages captured.
 func (c *PcapClient) Close() {
 	c.cancel()
-	for _, handler := range c.handlers {
-		handler.handle.Close()
+	c.watchWg.Wait()
+	c.closeDevices()
+	if c.file != nil {
+		<-c.done
+		c.file.Close()
 	}
+	c.common.Close()
 }
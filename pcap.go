@@ -2,36 +2,228 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket/pcap"
+	"github.com/pkg/errors"
 
 	"github.com/chenjiandongx/dnstrack/codec"
 	"github.com/chenjiandongx/dnstrack/formatter"
 )
 
+// dnsFilter returns the filter expression of the dns ports, it also lets through
+// IPv6 packets carrying extension headers since the udp/tcp primitives only
+// inspect the fixed header's next-header field, and the non-first IPv4 fragments
+// which carry no ports.
+func dnsFilter(ports []int) string {
+	exprs := make([]string, 0, len(ports))
+	for _, port := range ports {
+		exprs = append(exprs, fmt.Sprintf("port %d", port))
+	}
+	return fmt.Sprintf("((udp or tcp) and (%s)) or (ip and ip[6:2] & 0x1fff != 0) or (ip6 and (ip6 proto 0 or ip6 proto 43 or ip6 proto 44 or ip6 proto 51 or ip6 proto 60))", strings.Join(exprs, " or "))
+}
+
+// bpfFilter returns the capture filter for the link type. The vlan primitive
+// shifts the offsets for the remainder of the expression, hence the nested form
+// matches the untagged, single tagged and double tagged(QinQ) ethernet frames,
+// and the extra expression is repeated in each level to be evaluated on the
+// offsets of the ip header.
+func bpfFilter(linkType dlt, ports []int, extra string) string {
+	filter := dnsFilter(ports)
+	if extra != "" {
+		filter = fmt.Sprintf("(%s) and (%s)", extra, filter)
+	}
+	if linkType == dltEthernet {
+		filter = fmt.Sprintf("(%[1]s) or (vlan and ((%[1]s) or (vlan and (%[1]s))))", filter)
+	}
+	return filter
+}
+
 const (
-	dnsPort   = 53
-	bpfFilter = "udp and port 53"
+	transportUDP = "udp"
+	transportTCP = "tcp"
 )
 
+const (
+	mdnsPort  = 5353
+	llmnrPort = 5355
+
+	protocolMDNS  = "mdns"
+	protocolLLMNR = "llmnr"
+)
+
+const (
+	timestampKernel   = "kernel"
+	timestampHardware = "hardware"
+)
+
+func checkTimestamp(source string) error {
+	switch source {
+	case timestampKernel, timestampHardware:
+		return nil
+	}
+	return errors.Errorf("unsupported timestamp source(%s)", source)
+}
+
 type SP struct {
-	Server  string
-	Payload []byte
+	Server    string
+	Transport string
+	Payload   []byte
+
+	// Src and Dst are the endpoints of the message
+	Src netip.AddrPort
+	Dst netip.AddrPort
+
+	// VLANs are the 802.1Q tags from the outermost one
+	VLANs []uint16
+
+	// Multicast is the protocol(mdns/llmnr) of the message which is displayed
+	// as a standalone event, the server is the sender in this case.
+	Multicast string
+
+	// Process is the local process which sent the query if attributed
+	Process *formatter.Process
+
+	// Netns is the inode of the network namespace the message was captured
+	// in, it's 0 for the files which aren't attributed to the processes
+	Netns uint64
+
+	// Frame is the raw link-layer frame carrying the payload, it's nil for
+	// the messages reassembled from tcp streams.
+	Frame    []byte
+	LinkType dlt
+
+	// Segments are the frames of the tcp segments or ip fragments carrying the
+	// message, they are only kept when the matched transactions are written to
+	// file.
+	Segments []capturedFrame
 }
 
 type Stats struct {
+	Queries    int64
+	Events     int64
+	EventsDrop int64
+	Drop       int64
+	Missing    int64
+	Mismatched int64
+	Timeouts   int64
+	Duplicates int64
+	Expired    int64
+	Evicted    int64
+	Unmatched  int64
+
+	// Workloads are the queries grouped by the workloads in descending order
+	Workloads []WorkloadStats
+
+	// Servers are the queries per server in descending order of the retries
+	Servers []ServerStats
+
+	// Devices are the capture counters of the devices including the detached
+	// ones sorted by the name
+	Devices []DeviceStats
+
+	Pipeline PipelineStats
+}
+
+type DeviceStats struct {
+	Device   string
+	Received uint64
+	Dropped  uint64
+}
+
+type ServerStats struct {
+	Server  string
 	Queries int64
-	Drop    int64
-	Missing int64
+	Retries int64
 }
 
+type WorkloadStats struct {
+	Key     string
+	Queries int64
+}
+
+// dnsPorts is the set of ports that the dns servers listen on.
+type dnsPorts map[uint16]struct{}
+
+// withMulticastPorts merges the mDNS and LLMNR ports into the dns ports.
+func withMulticastPorts(ports []int) []int {
+	r := append([]int(nil), ports...)
+	for _, port := range []int{mdnsPort, llmnrPort} {
+		var found bool
+		for _, p := range ports {
+			found = found || p == port
+		}
+		if !found {
+			r = append(r, port)
+		}
+	}
+	return r
+}
+
+func newDNSPorts(ports []int) (dnsPorts, error) {
+	if len(ports) == 0 {
+		return nil, errors.New("no dns ports specified")
+	}
+
+	p := make(dnsPorts, len(ports))
+	for _, port := range ports {
+		if port <= 0 || port > 65535 {
+			return nil, errors.Errorf("invalid dns port(%d)", port)
+		}
+		p[uint16(port)] = struct{}{}
+	}
+	return p, nil
+}
+
+// serverAddr returns the dns server endpoint in host:port form, it reports false
+// if none of the ports is the dns port.
+func (p dnsPorts) serverAddr(srcIP, dstIP net.IP, srcPort, dstPort uint16) (string, bool) {
+	if _, ok := p[srcPort]; ok {
+		return net.JoinHostPort(srcIP.String(), strconv.Itoa(int(srcPort))), true
+	}
+	if _, ok := p[dstPort]; ok {
+		return net.JoinHostPort(dstIP.String(), strconv.Itoa(int(dstPort))), true
+	}
+	return "", false
+}
+
+// anyDevice is the pseudo device capturing on all the devices, it's captured only
+// if matched by the devices pattern since the frames are duplicates of the ones
+// captured on the other devices.
+const anyDevice = "any"
+
 func ListAllDevices() ([]pcap.Interface, error) {
 	return pcap.FindAllDevs()
 }
 
+// handleDLT resolves the link type of the handle by its name since the value
+// reported through gopacket is truncated, it reports false if the link type is
+// unsupported.
+func handleDLT(h *pcap.Handle) (dlt, bool) {
+	links, err := h.ListDataLinks()
+	if err != nil {
+		return 0, false
+	}
+	for _, link := range links {
+		if pcap.DatalinkNameToVal(link.Name)&0xff != int(h.LinkType()) {
+			continue
+		}
+		if t, ok := dltNames[link.Name]; ok {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
 func filterDevices(devices string, allowAll bool) ([]pcap.Interface, error) {
 	all, err := ListAllDevices()
 	if err != nil {
@@ -53,7 +245,7 @@ func filterDevices(devices string, allowAll bool) ([]pcap.Interface, error) {
 				devs = append(devs, device)
 			}
 		} else {
-			if allowAll {
+			if allowAll && device.Name != anyDevice {
 				devs = append(devs, device)
 			}
 		}
@@ -62,23 +254,200 @@ func filterDevices(devices string, allowAll bool) ([]pcap.Interface, error) {
 	return devs, nil
 }
 
+// The modes of displaying the transactions, the queries and responses are
+// displayed as separate events linked by the transaction id in the both mode.
+const (
+	modeResponse = "response"
+	modeQuery    = "query"
+	modeBoth     = "both"
+)
+
+func checkMode(mode string) error {
+	switch mode {
+	case modeResponse, modeQuery, modeBoth:
+		return nil
+	}
+	return errors.Errorf("unsupported mode(%s)", mode)
+}
+
+// sweepInterval is how often the queries are checked for timeouts, the
+// resolutions for completion and the answered transactions for expiration
+const sweepInterval = 100 * time.Millisecond
+
+// unmatchedGrace is how long the unmatched responses are held for their queries
+// if matching across the devices since the devices are captured concurrently
+// and nothing orders the packets among them.
+const unmatchedGrace = 500 * time.Millisecond
+
+type commonOptions struct {
+	mode        string
+	timeout     time.Duration
+	crossDevice bool
+	correlate   bool
+	collapse    bool
+	window      time.Duration
+	cacheSize   int
+	cacheTTL    time.Duration
+	pipeline    pipelineOptions
+	process     bool
+	workload    workloadFilter
+}
+
+func newCommonOptions(opt Options) (commonOptions, error) {
+	if err := checkMode(opt.Mode); err != nil {
+		return commonOptions{}, err
+	}
+	if opt.Timeout < 0 {
+		return commonOptions{}, errors.Errorf("invalid timeout(%s)", opt.Timeout)
+	}
+	if opt.DuplicateWindow < 0 {
+		return commonOptions{}, errors.Errorf("invalid duplicate window(%s)", opt.DuplicateWindow)
+	}
+	if opt.CacheSize < 1 {
+		return commonOptions{}, errors.Errorf("invalid cache size(%d)", opt.CacheSize)
+	}
+	if opt.CacheTTL < 0 {
+		return commonOptions{}, errors.Errorf("invalid cache ttl(%s)", opt.CacheTTL)
+	}
+	// the queries are reported as timeouts before they're expired
+	if opt.Timeout > 0 && opt.CacheTTL > 0 && opt.Timeout >= opt.CacheTTL {
+		return commonOptions{}, errors.Errorf("invalid timeout(%s), it must be shorter than the cache ttl(%s)", opt.Timeout, opt.CacheTTL)
+	}
+	if opt.Collapse && opt.Mode != modeResponse {
+		return commonOptions{}, errors.Errorf("collapse is unsupported in mode(%s)", opt.Mode)
+	}
+	popt, err := newPipelineOptions(opt)
+	if err != nil {
+		return commonOptions{}, err
+	}
+	return commonOptions{
+		mode:        opt.Mode,
+		timeout:     opt.Timeout,
+		crossDevice: opt.CrossDevice,
+		correlate:   opt.Correlate || opt.Collapse,
+		collapse:    opt.Collapse,
+		window:      opt.DuplicateWindow,
+		cacheSize:   opt.CacheSize,
+		cacheTTL:    opt.CacheTTL,
+		pipeline:    popt,
+		process:     opt.Process,
+		workload:    workloadFilter{cgroup: opt.Cgroup, container: opt.Container},
+	}, nil
+}
+
 type CommonClient struct {
-	cache *cache
-	f     formatter.Formatter
+	cache    *cache
+	f        formatter.Formatter
+	w        *pcapWriter
+	p        *pipeline
+	procs    *procTable
+	workload workloadFilter
+
+	queries    atomic.Int64
+	events     atomic.Int64
+	dropped    atomic.Int64
+	eventsDrop atomic.Int64
+	mismatched atomic.Int64
+	timeouts   atomic.Int64
+	duplicates atomic.Int64
+	unmatched  atomic.Int64
+	txid       atomic.Uint64
+
+	mode        string
+	cacheTTL    time.Duration
+	timeout     time.Duration
+	crossDevice bool
+	cacheSize   int
+	copies      *copyTable
+	corr        *correlator
+	collapse    bool
+	dups        *dupTable
+	window      time.Duration
+	sweepDone   chan struct{}
+	sweepWg     sync.WaitGroup
 
-	queries  atomic.Int64
-	dropped  atomic.Int64
-	response atomic.Int64
+	// held are the unmatched responses held for the grace period
+	heldMu sync.Mutex
+	held   []*job
+
+	mu        sync.Mutex
+	workloads map[string]int64
+	servers   map[string]*ServerStats
+}
+
+func NewCommonClient(f formatter.Formatter, w *pcapWriter, opt commonOptions) *CommonClient {
+	c := &CommonClient{
+		cache:       newCache(opt.cacheSize),
+		f:           f,
+		w:           w,
+		mode:        opt.mode,
+		timeout:     opt.timeout,
+		crossDevice: opt.crossDevice,
+		cacheSize:   opt.cacheSize,
+		collapse:    opt.collapse,
+		window:      opt.window,
+		cacheTTL:    opt.cacheTTL,
+		workload:    opt.workload,
+		sweepDone:   make(chan struct{}),
+		workloads:   make(map[string]int64),
+		servers:     make(map[string]*ServerStats),
+	}
+	if opt.process {
+		c.procs = newProcTable()
+	}
+	if opt.crossDevice {
+		c.copies = newCopyTable(opt.cacheSize)
+	}
+	if opt.correlate {
+		c.corr = newCorrelator()
+	}
+	if c.window > 0 {
+		c.dups = newDupTable(opt.cacheSize)
+	}
+	c.p = newPipeline(opt.pipeline, os.Stdout, c.process)
+	if c.timeout > 0 || c.cacheTTL > 0 || c.crossDevice || c.corr != nil || c.dups != nil {
+		c.sweepWg.Add(1)
+		go c.sweep()
+	}
+	return c
 }
 
-func NewCommonClient(f formatter.Formatter) *CommonClient {
-	return &CommonClient{
-		cache: newCache(),
-		f:     f,
+// Record writes the captured frame to file unless only the matched transactions
+// are expected.
+func (c *CommonClient) Record(device string, linkType dlt, ts time.Time, frame []byte) {
+	if c.w != nil && !c.w.matched {
+		c.w.Write(device, linkType, ts, frame)
 	}
 }
 
+// Display queues the message for decoding, the payload and frame are copied
+// hence they can be reused once it returns.
 func (c *CommonClient) Display(sp *SP, device string, ts time.Time) {
+	c.p.enqueue(sp, device, ts, c.w != nil && c.w.matched)
+}
+
+// process decodes the message and matches the response with the query, it's
+// run by the decoder workers.
+func (c *CommonClient) process(j *job) {
+	sp, device, ts := &j.sp, j.device, j.ts
+	// the packets crossing several devices are captured on each of them, the
+	// copies aren't counted as the retransmissions or duplicates
+	if c.copies != nil && !j.held && c.copies.seen(sp, device, ts) {
+		return
+	}
+	// the sender of the queries and multicast messages is the local process if
+	// any, the other workloads aren't tracked at all
+	if len(sp.Payload) > 2 && (sp.Payload[2]&0x80 == 0 || sp.Multicast != "") {
+		sp.Process = c.lookupProcess(sp, sp.Src)
+		if !c.workload.pass(sp.Process) {
+			return
+		}
+	}
+	if sp.Multicast != "" {
+		c.displayEvent(sp, device, ts)
+		return
+	}
+
 	size := len(sp.Payload)
 	r, err := codec.Decode(sp.Payload)
 	if err != nil {
@@ -86,40 +455,572 @@ func (c *CommonClient) Display(sp *SP, device string, ts time.Time) {
 	}
 
 	header := r.Header
-	uk := fmt.Sprintf("%s/%d", device, header.ID)
+	// the device is left out of the keys if matching across the devices
+	keyDevice := device
+	if c.crossDevice {
+		keyDevice = ""
+	}
+	key := txKey{device: keyDevice, transport: sp.Transport, client: sp.Src, server: sp.Dst, id: header.ID}
+	question := parseQuestion(sp.Payload)
 	if !header.Response {
-		c.queries.Add(1)
-		c.cache.set(uk, ts)
+		e := entry{
+			when:     ts,
+			device:   device,
+			size:     size,
+			question: question,
+			msg:      r,
+			server:   sp.Server,
+			vlans:    sp.VLANs,
+			process:  sp.Process,
+		}
+		if c.mode == modeBoth {
+			e.txid = c.txid.Add(1)
+		}
+		if c.mode == modeResponse && c.w != nil && c.w.matched {
+			e.frames = framesOf(sp, device, ts, true)
+		}
+		if c.corr != nil {
+			var finished []*resolution
+			e.res, e.hop, finished = c.corr.open(question, sp.Src, sp.Dst, ts)
+			for _, r := range finished {
+				c.displayResolution(r)
+			}
+		}
+		txid, retransmitted, dropped := c.cache.add(key, e)
+		// the retransmission merged into the pending query is linked with its
+		// response by the txid of the pending one
+		e.txid = txid
+		for _, d := range dropped {
+			c.abandon(d)
+		}
+		c.countServer(sp.Server, retransmitted)
+		// the retransmissions are counted as attempts of the same query
+		if !retransmitted {
+			c.queries.Add(1)
+			c.countWorkload(sp.Process)
+		}
+		if c.mode != modeResponse {
+			shown := c.displayMessage(sp, r, device, ts, e)
+			// the drops are counted once per transaction, by the response
+			// event in the both mode
+			if !shown && c.mode == modeQuery && !retransmitted {
+				c.dropped.Add(1)
+			}
+		}
+		return
+	}
+
+	key.client, key.server = sp.Dst, sp.Src
+	e, dropped, ok, mismatched := c.cache.take(key, question)
+	for _, d := range dropped {
+		c.abandon(d)
+	}
+	if mismatched {
+		c.displayMismatch(sp, r, device, ts)
 		return
 	}
-	t, ok := c.cache.get(uk)
+	dk := dupKey{device: keyDevice, transport: sp.Transport, client: sp.Dst, id: header.ID, question: question}
 	if !ok {
+		// the queries of the other workloads aren't tracked, neither are the
+		// responses to them
+		if c.workload.active() && !c.workload.pass(c.lookupProcess(sp, sp.Dst)) {
+			return
+		}
+		if c.dups != nil {
+			if a, ok := c.dups.get(dk); ok && ts.Sub(a.when) < c.window {
+				c.displayDuplicate(sp, r, device, ts, a)
+				return
+			}
+		}
+		// the query may be captured on another device but not processed yet
+		if c.crossDevice && !j.held {
+			c.hold(j)
+			return
+		}
+		c.displayUnmatched(sp, r, device, ts)
 		return
 	}
 
-	s, ok := c.f.Format(formatter.MessageWrap{
-		When:     t,
-		Size:     size,
-		Duration: time.Since(t),
-		Msg:      r,
-		Device:   device,
-		Server:   sp.Server,
-	})
+	wrap := formatter.MessageWrap{
+		When:      e.when,
+		Size:      size,
+		Duration:  ts.Sub(e.when),
+		Msg:       r,
+		Device:    device,
+		Server:    sp.Server,
+		Transport: sp.Transport,
+		VLANs:     sp.VLANs,
+		Process:   e.process,
+	}
+	if e.attempts > 1 {
+		wrap.When = e.first
+		wrap.Attempts, wrap.Total = e.attempts, ts.Sub(e.first)
+	}
+	if e.res != nil {
+		wrap.Correlation = e.res.id
+		var frames []capturedFrame
+		if c.collapse && c.w != nil && c.w.matched {
+			frames = append(e.frames, framesOf(sp, device, ts, true)...)
+		}
+		c.corr.answer(e.res, e.hop, ts, wrap, frames)
+	}
+	if c.dups != nil {
+		a := &answered{
+			key:         dk,
+			when:        ts,
+			queried:     e.when,
+			src:         sp.Src,
+			txid:        e.txid,
+			correlation: wrap.Correlation,
+			process:     e.process,
+		}
+		a.records, a.ttls = summarizeAnswers(r)
+		c.dups.add(a)
+	}
+
+	switch {
+	case c.mode == modeQuery || c.collapse:
+		return
+	case c.mode == modeBoth:
+		if !c.displayMessage(sp, r, device, ts, e) {
+			c.dropped.Add(1)
+		}
+		return
+	}
+
+	s, ok := c.f.Format(wrap)
 	if ok {
-		c.response.Add(1)
-		fmt.Println(s)
+		c.p.emit(s)
+		c.writeMatched(e.frames)
+		c.writeMatched(framesOf(sp, device, ts, false))
 	} else {
 		c.dropped.Add(1)
 	}
 }
 
+// lookupProcess returns the process owning the local socket bound to the
+// address, the messages read from files aren't attributed.
+func (c *CommonClient) lookupProcess(sp *SP, addr netip.AddrPort) *formatter.Process {
+	if c.procs == nil || sp.Netns == 0 {
+		return nil
+	}
+	return c.procs.lookup(sp.Netns, sp.Transport, addr)
+}
+
+// displayMessage displays the query or response as a separate event in the
+// query and both modes, the frame is written on its own if it passes the
+// filters. It reports false if filtered out, the drop is counted by the caller.
+func (c *CommonClient) displayMessage(sp *SP, r *codec.Message, device string, ts time.Time, e entry) bool {
+	wrap := formatter.MessageWrap{
+		When:      ts,
+		Size:      len(sp.Payload),
+		Msg:       r,
+		Device:    device,
+		Server:    sp.Server,
+		Transport: sp.Transport,
+		VLANs:     sp.VLANs,
+		Event:     modeQuery,
+		TxID:      e.txid,
+		Process:   e.process,
+	}
+	if r.Header.Response {
+		wrap.Event, wrap.Duration = modeResponse, ts.Sub(e.when)
+		if e.attempts > 1 {
+			wrap.Attempts, wrap.Total = e.attempts, ts.Sub(e.first)
+		}
+	}
+	if e.res != nil {
+		wrap.Correlation = e.res.id
+	}
+
+	s, ok := c.f.Format(wrap)
+	if !ok {
+		return false
+	}
+
+	c.p.emit(s)
+	c.writeMatched(framesOf(sp, device, ts, false))
+	return true
+}
+
+// framesOf returns the frames carrying the message, the frame is copied if it's
+// kept after the processing since the buffer of the job is reused.
+func framesOf(sp *SP, device string, ts time.Time, keep bool) []capturedFrame {
+	if sp.Segments != nil || sp.Frame == nil {
+		return sp.Segments
+	}
+	data := sp.Frame
+	if keep {
+		data = append([]byte(nil), data...)
+	}
+	return []capturedFrame{{device: device, linkType: sp.LinkType, ts: ts, data: data}}
+}
+
+// writeMatched writes the frames of the transaction passing the filters if only
+// the matched transactions are expected.
+func (c *CommonClient) writeMatched(frames []capturedFrame) {
+	if c.w == nil || !c.w.matched {
+		return
+	}
+	for _, f := range frames {
+		c.w.Write(f.device, f.linkType, f.ts, f.data)
+	}
+}
+
+// now returns the capture time by now, zero if nothing is captured yet. The
+// timeouts are checked in terms of the capture time so that the files are
+// expired as they were captured.
+func (c *CommonClient) now() time.Time {
+	return c.p.clock()
+}
+
+func (c *CommonClient) sweep() {
+	defer c.sweepWg.Done()
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.sweepDone:
+			return
+		case <-ticker.C:
+			now := c.now()
+			if now.IsZero() {
+				continue
+			}
+			if c.crossDevice {
+				c.releaseHeld(now)
+				c.copies.expire(now)
+			}
+			// the queries timed out are kept until expired by the ttl so
+			// that the late responses still match
+			if c.timeout > 0 {
+				timeouts, superseded := c.cache.timeout(now, c.timeout)
+				for _, e := range superseded {
+					c.abandon(e)
+				}
+				for _, p := range timeouts {
+					c.abandon(p.entry)
+					c.displayTimeout(&p, now)
+				}
+			}
+			if c.cacheTTL > 0 {
+				for _, p := range c.cache.expire(now, c.cacheTTL) {
+					c.abandon(p.entry)
+				}
+			}
+			if c.dups != nil {
+				c.dups.expire(now, c.window)
+			}
+			if c.corr != nil {
+				for _, r := range c.corr.expire(now) {
+					c.displayResolution(r)
+				}
+			}
+		}
+	}
+}
+
+// hold holds the unmatched response for the grace period, the oldest one is
+// processed again at once if there are too many.
+func (c *CommonClient) hold(j *job) {
+	h := newJob(&j.sp, j.device, j.ts, j.sp.Frame != nil)
+	h.held = true
+
+	var oldest *job
+	c.heldMu.Lock()
+	if len(c.held) >= c.cacheSize {
+		oldest = c.held[0]
+		c.held = c.held[1:]
+	}
+	c.held = append(c.held, h)
+	c.heldMu.Unlock()
+
+	if oldest != nil {
+		c.process(oldest)
+		releaseJob(oldest)
+	}
+}
+
+// releaseHeld processes the responses held for the grace period by now again,
+// all of them if now is zero.
+func (c *CommonClient) releaseHeld(now time.Time) {
+	var due []*job
+	c.heldMu.Lock()
+	held := c.held[:0]
+	for _, j := range c.held {
+		if now.IsZero() || now.Sub(j.ts) >= unmatchedGrace {
+			due = append(due, j)
+			continue
+		}
+		held = append(held, j)
+	}
+	for i := len(held); i < len(c.held); i++ {
+		c.held[i] = nil
+	}
+	c.held = held
+	c.heldMu.Unlock()
+
+	for _, j := range due {
+		c.process(j)
+		releaseJob(j)
+	}
+}
+
+// abandon gives up the hop of the query timed out or removed unanswered.
+func (c *CommonClient) abandon(e entry) {
+	if e.res != nil {
+		c.corr.abandon(e.res, e.hop)
+	}
+}
+
+// displayResolution displays the lookup correlated across the hops once it's
+// answered, only in the collapsed view.
+func (c *CommonClient) displayResolution(r *resolution) {
+	if !c.collapse {
+		return
+	}
+	wrap, ok := r.collapse()
+	if !ok {
+		return
+	}
+	s, ok := c.f.Format(wrap)
+	if !ok {
+		c.dropped.Add(1)
+		return
+	}
+	c.p.emit(s)
+	for _, h := range r.hops {
+		c.writeMatched(h.frames)
+	}
+}
+
+// displayTimeout displays the query unanswered within the timeout.
+func (c *CommonClient) displayTimeout(p *pending, now time.Time) {
+	c.timeouts.Add(1)
+	wrap := formatter.MessageWrap{
+		When:      p.when,
+		Size:      p.size,
+		Duration:  now.Sub(p.when),
+		Msg:       p.msg,
+		Device:    p.device,
+		Server:    p.server,
+		Transport: p.key.transport,
+		VLANs:     p.vlans,
+		Event:     "timeout",
+		TxID:      p.txid,
+		Process:   p.process,
+	}
+	if p.attempts > 1 {
+		wrap.Attempts, wrap.Total = p.attempts, now.Sub(p.first)
+	}
+	if p.res != nil {
+		wrap.Correlation = p.res.id
+	}
+	s, ok := c.f.Format(wrap)
+	if ok {
+		c.p.emit(s)
+	}
+}
+
+// displayDuplicate displays the extra response of the transaction answered
+// already along with what it differs from the first one in.
+func (c *CommonClient) displayDuplicate(sp *SP, r *codec.Message, device string, ts time.Time, a *answered) {
+	c.duplicates.Add(1)
+	records, ttls := summarizeAnswers(r)
+	s, ok := c.f.Format(formatter.MessageWrap{
+		When:        ts,
+		Size:        len(sp.Payload),
+		Duration:    ts.Sub(a.queried),
+		Msg:         r,
+		Device:      device,
+		Server:      sp.Server,
+		Transport:   sp.Transport,
+		VLANs:       sp.VLANs,
+		Event:       "duplicate",
+		Differs:     a.diff(sp.Src, records, ttls),
+		TxID:        a.txid,
+		Correlation: a.correlation,
+		Process:     a.process,
+	})
+	if !ok {
+		return
+	}
+
+	c.p.emit(s)
+	c.writeMatched(framesOf(sp, device, ts, false))
+}
+
+// displayUnmatched displays the response without the query, e.g. the capture
+// started in the middle of the transaction, the query timed out already or
+// it's routed through the other devices, the latency is unknown hence.
+func (c *CommonClient) displayUnmatched(sp *SP, r *codec.Message, device string, ts time.Time) {
+	c.unmatched.Add(1)
+	s, ok := c.f.Format(formatter.MessageWrap{
+		When:      ts,
+		Size:      len(sp.Payload),
+		Msg:       r,
+		Device:    device,
+		Server:    sp.Server,
+		Transport: sp.Transport,
+		VLANs:     sp.VLANs,
+		Event:     "unmatched",
+	})
+	if ok {
+		c.p.emit(s)
+	}
+}
+
+// displayMismatch displays the response whose question differs from the ones
+// of the pending queries, the query stays pending for its own response.
+func (c *CommonClient) displayMismatch(sp *SP, r *codec.Message, device string, ts time.Time) {
+	c.mismatched.Add(1)
+	s, ok := c.f.Format(formatter.MessageWrap{
+		When:      ts,
+		Size:      len(sp.Payload),
+		Msg:       r,
+		Device:    device,
+		Server:    sp.Server,
+		Transport: sp.Transport,
+		VLANs:     sp.VLANs,
+		Event:     "mismatch",
+	})
+	if ok {
+		c.p.emit(s)
+	}
+}
+
+// displayEvent displays the mDNS/LLMNR message on its own since the responses
+// are mostly unsolicited and the IDs can't be used for matching.
+func (c *CommonClient) displayEvent(sp *SP, device string, ts time.Time) {
+	decode := codec.Decode
+	if sp.Multicast == protocolMDNS {
+		decode = codec.DecodeMDNS
+	}
+	r, err := decode(sp.Payload)
+	if err != nil {
+		return
+	}
+
+	event := sp.Multicast + "-query"
+	if r.Header.Response {
+		event = sp.Multicast + "-response"
+	}
+
+	c.events.Add(1)
+	c.countWorkload(sp.Process)
+	s, ok := c.f.Format(formatter.MessageWrap{
+		When:      ts,
+		Size:      len(sp.Payload),
+		Msg:       r,
+		Device:    device,
+		Server:    sp.Server,
+		Transport: sp.Transport,
+		VLANs:     sp.VLANs,
+		Event:     event,
+		Process:   sp.Process,
+	})
+	if !ok {
+		c.eventsDrop.Add(1)
+		return
+	}
+
+	c.p.emit(s)
+	c.writeMatched(framesOf(sp, device, ts, false))
+}
+
+// Close drains the pipeline, the messages are no longer displayed after it.
+func (c *CommonClient) Close() {
+	c.p.closeDecoders()
+	close(c.sweepDone)
+	c.sweepWg.Wait()
+	c.releaseHeld(time.Time{})
+	if c.corr != nil {
+		for _, r := range c.corr.expire(time.Time{}) {
+			c.displayResolution(r)
+		}
+	}
+	c.p.closeOutput()
+	if c.w != nil {
+		c.w.Close()
+	}
+}
+
+// countServer counts the queries and the retransmissions per server.
+func (c *CommonClient) countServer(server string, retransmitted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.servers[server]
+	if !ok {
+		s = &ServerStats{Server: server}
+		c.servers[server] = s
+	}
+	s.Queries++
+	if retransmitted {
+		s.Retries++
+	}
+}
+
+func (c *CommonClient) countWorkload(p *formatter.Process) {
+	if p == nil {
+		return
+	}
+	key := workloadKey(p)
+	if key == "" {
+		return
+	}
+
+	c.mu.Lock()
+	c.workloads[key]++
+	c.mu.Unlock()
+}
+
 func (c *CommonClient) Stats() Stats {
 	queries := c.queries.Load()
 	dropped := c.dropped.Load()
-	missing := queries - c.response.Load()
+	// the queries expired or pending are unanswered, the evicted ones are
+	// unknown
+	expirations := c.cache.expirations.Load()
+	missing := expirations + int64(c.cache.len())
+
+	c.mu.Lock()
+	workloads := make([]WorkloadStats, 0, len(c.workloads))
+	for key, n := range c.workloads {
+		workloads = append(workloads, WorkloadStats{Key: key, Queries: n})
+	}
+	servers := make([]ServerStats, 0, len(c.servers))
+	for _, s := range c.servers {
+		servers = append(servers, *s)
+	}
+	c.mu.Unlock()
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Retries != servers[j].Retries {
+			return servers[i].Retries > servers[j].Retries
+		}
+		return servers[i].Server < servers[j].Server
+	})
+	sort.Slice(workloads, func(i, j int) bool {
+		if workloads[i].Queries != workloads[j].Queries {
+			return workloads[i].Queries > workloads[j].Queries
+		}
+		return workloads[i].Key < workloads[j].Key
+	})
+
 	return Stats{
-		Queries: queries,
-		Drop:    dropped,
-		Missing: missing,
+		Queries:    queries,
+		Events:     c.events.Load(),
+		EventsDrop: c.eventsDrop.Load(),
+		Drop:       dropped,
+		Missing:    missing,
+		Mismatched: c.mismatched.Load(),
+		Timeouts:   c.timeouts.Load(),
+		Duplicates: c.duplicates.Load(),
+		Expired:    expirations,
+		Evicted:    c.cache.evictions.Load(),
+		Unmatched:  c.unmatched.Load(),
+		Workloads:  workloads,
+		Servers:    servers,
+		Pipeline:   c.p.stats(),
 	}
 }
@@ -3,10 +3,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/pkg/errors"
 
@@ -14,134 +18,248 @@ import (
 )
 
 type pcapHandler struct {
-	device string
-	handle *pcap.Handle
+	device   string
+	linkType dlt
+	handle   *pcap.Handle
+	parser   *parser
 }
 
 type PcapClient struct {
-	opt         Options
-	handlers    []*pcapHandler
-	common      *CommonClient
-	maxIfaceLen int
+	ctx        context.Context
+	cancel     context.CancelFunc
+	opt        Options
+	ports      dnsPorts
+	file       *pcapHandler
+	done       chan struct{}
+	common     *CommonClient
+	ifaceWidth *atomic.Int64
+	netns      []netns
+
+	watchWg sync.WaitGroup
+	mu      sync.Mutex
+	devices map[string]*attachedDevice
+	// skipped are the indexes of the devices which can't be captured
+	skipped  map[string]int
+	detached map[string]DeviceStats
 }
 
 func NewPcapClient(opt Options) (*PcapClient, error) {
-	client := &PcapClient{opt: opt}
-	if err := client.getAvailableDevices(); err != nil {
+	if opt.Multicast {
+		opt.Ports = withMulticastPorts(opt.Ports)
+	}
+	// the workloads are told by the processes
+	if opt.Cgroup != "" || opt.Container != "" {
+		opt.Process = true
+	}
+	ports, err := newDNSPorts(opt.Ports)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTimestamp(opt.Timestamp); err != nil {
+		return nil, err
+	}
+	copt, err := newCommonOptions(opt)
+	if err != nil {
 		return nil, err
 	}
+	// listeners wake up periodically to notice the detachment
+	if opt.PollTimeout <= 0 {
+		return nil, errors.Errorf("invalid poll timeout(%s)", opt.PollTimeout)
+	}
+	if len(opt.Netns) > 0 {
+		return nil, errors.New("network namespaces are only supported on linux")
+	}
+	if opt.Process {
+		return nil, errors.New("process attribution is only supported on linux")
+	}
+
+	client := &PcapClient{
+		opt:        opt,
+		ports:      ports,
+		done:       make(chan struct{}),
+		ifaceWidth: &atomic.Int64{},
+		netns:      []netns{{}},
+		devices:    make(map[string]*attachedDevice),
+		skipped:    make(map[string]int),
+		detached:   make(map[string]DeviceStats),
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	client.common = NewCommonClient(formatter.New(opt.Format, opt.Server, opt.Type, opt.Status, client.ifaceWidth), newPcapWriter(opt), copt)
 
-	client.common = NewCommonClient(formatter.New(opt.Format, opt.Server, opt.Type, client.maxIfaceLen))
-	for _, handler := range client.handlers {
-		go client.listen(handler)
+	if opt.ReadFile != "" {
+		if err := client.openFile(); err != nil {
+			return nil, err
+		}
+		client.file.parser = newParser(client.common, client.file.device, client.file.linkType, client.ports, opt.Multicast, 0)
+		go client.readFile(client.file)
+		return client, nil
 	}
 
+	if err := client.getAvailableDevices(); err != nil {
+		return nil, err
+	}
+	if opt.WatchInterval > 0 {
+		client.startWatcher()
+	}
 	return client, nil
 }
 
-func (c *PcapClient) getAvailableDevices() error {
-	devs, err := filterDevices(c.opt.Devices, c.opt.AllDevices)
+// openDevice opens the device, no handlers are returned for the devices whose
+// frames can't be decoded, e.g. 802.11 radiotap.
+func (c *PcapClient) openDevice(ns netns, device string) ([]*pcapHandler, error) {
+	handler, err := c.getHandler(device)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "get device(%s) name failed", device)
 	}
 
-	for _, device := range devs {
-		handler, err := c.getHandler(device.Name, bpfFilter)
-		if err != nil {
-			return errors.Wrapf(err, "get device(%s) name failed", device.Name)
-		}
+	linkType, ok := handleDLT(handler)
+	if !ok {
+		handler.Close()
+		return nil, nil
+	}
+	if err = handler.SetBPFFilter(bpfFilter(linkType, c.opt.Ports, c.opt.BPFFilter)); err != nil {
+		handler.Close()
+		return nil, errors.Wrapf(err, "set bpf-filter on device(%s) failed", device)
+	}
 
-		if c.maxIfaceLen < len(device.Name) {
-			c.maxIfaceLen = len(device.Name)
-		}
-		c.handlers = append(c.handlers, &pcapHandler{
-			device: device.Name,
-			handle: handler,
-		})
+	return []*pcapHandler{{
+		device:   device,
+		linkType: linkType,
+		handle:   handler,
+	}}, nil
+}
+
+func (c *PcapClient) openFile() error {
+	handle, err := pcap.OpenOffline(c.opt.ReadFile)
+	if err != nil {
+		return errors.Wrapf(err, "open file(%s) failed", c.opt.ReadFile)
 	}
 
-	if len(c.handlers) == 0 {
-		return errors.New("no available devices found")
+	linkType, ok := handleDLT(handle)
+	if !ok {
+		handle.Close()
+		return errors.Errorf("unsupported link type(%s) of file(%s)", handle.LinkType(), c.opt.ReadFile)
+	}
+
+	if err = handle.SetBPFFilter(bpfFilter(linkType, c.opt.Ports, c.opt.BPFFilter)); err != nil {
+		handle.Close()
+		return errors.Wrapf(err, "set bpf-filter on file(%s) failed", c.opt.ReadFile)
 	}
 
+	device := filepath.Base(c.opt.ReadFile)
+	c.ifaceWidth.Store(int64(len(device)))
+	c.file = &pcapHandler{
+		device:   device,
+		linkType: linkType,
+		handle:   handle,
+	}
 	return nil
 }
 
-func (c *PcapClient) getHandler(device, filter string) (*pcap.Handle, error) {
-	handle, err := pcap.OpenLive(device, 65535, false, pcap.BlockForever)
+// getHandler opens the device, the adapter timestamps are used if required and
+// supported by the NIC. The nanosecond precision is requested by Activate and
+// the microsecond one is kept if libpcap doesn't support it.
+func (c *PcapClient) getHandler(device string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
 	if err != nil {
 		return nil, err
 	}
+	defer inactive.CleanUp()
 
-	if err := handle.SetBPFFilter(filter); err != nil {
-		handle.Close()
+	if err = inactive.SetSnapLen(65535); err != nil {
+		return nil, err
+	}
+	if err = inactive.SetTimeout(c.opt.PollTimeout); err != nil {
 		return nil, err
 	}
+	if c.opt.Timestamp == timestampHardware {
+		if err = c.setAdapterTimestamp(inactive); err != nil {
+			fmt.Fprintf(os.Stderr, "Enable hardware timestamps on device(%s) failed: %v, fallback to kernel ones\n", device, err)
+		}
+	}
 
-	return handle, nil
+	return inactive.Activate()
 }
 
-func (c *PcapClient) parsePacket(packet gopacket.Packet) *SP {
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		return nil
-	}
-
-	ipv4pkg := ipLayer.(*layers.IPv4)
-	if ipv4pkg == nil {
-		return nil
+func (c *PcapClient) setAdapterTimestamp(inactive *pcap.InactiveHandle) error {
+	source, err := pcap.TimestampSourceFromString("adapter")
+	if err != nil {
+		return err
 	}
+	return inactive.SetTimestampSource(source)
+}
 
-	srcIP := ipv4pkg.SrcIP.String()
-	dstIP := ipv4pkg.DstIP.String()
+func (ph *pcapHandler) close() {
+	ph.handle.Close()
+}
 
-	layer := packet.Layer(layers.LayerTypeUDP)
-	pkg, ok := layer.(*layers.UDP)
-	if !ok {
-		return nil
+// listen reads packets until the device is detached or the file ends, the read
+// timeout wakes the blocking read up periodically when the device is idle.
+func (c *PcapClient) listen(ctx context.Context, ph *pcapHandler) {
+	for ctx.Err() == nil {
+		pkt, ci, err := ph.handle.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		c.common.Record(ph.device, ph.linkType, ci.Timestamp, pkt)
+		sp := ph.parser.parse(pkt, ci.Timestamp)
+		if sp == nil {
+			continue
+		}
+		sp.Frame, sp.LinkType = pkt, ph.linkType
+		c.common.Display(sp, ph.device, ci.Timestamp)
 	}
-	srcPort := uint16(pkg.SrcPort)
-	dstPort := uint16(pkg.DstPort)
+}
 
-	var server string
-	if srcPort == dnsPort {
-		server = fmt.Sprintf("%s:%d", srcIP, srcPort)
-	} else {
-		server = fmt.Sprintf("%s:%d", dstIP, dstPort)
-	}
+// readFile decodes all packets of the offline file with their recorded timestamps
+// and closes the done channel once the file ends.
+func (c *PcapClient) readFile(ph *pcapHandler) {
+	defer close(c.done)
+	c.listen(c.ctx, ph)
+}
 
-	return &SP{
-		Server:  server,
-		Payload: pkg.Payload,
-	}
+// Done returns a channel that's closed when there are no more packets to read.
+func (c *PcapClient) Done() <-chan struct{} {
+	return c.done
 }
 
-func (c *PcapClient) listen(ph *pcapHandler) {
-	packetSource := gopacket.NewPacketSource(ph.handle, ph.handle.LinkType())
-	packetSource.Lazy = true
-	packetSource.NoCopy = true
+// inNetns runs fn directly as there is only the current namespace here.
+func inNetns(ns netns, fn func() error) error {
+	return fn()
+}
 
-	for {
-		select {
-		case packet, ok := <-packetSource.Packets():
-			if !ok {
-				return
-			}
-			sp := c.parsePacket(packet)
-			if sp == nil {
-				continue
-			}
-			c.common.Display(sp, ph.device, packet.Metadata().Timestamp)
-		}
+// linkEvents isn't supported here, the devices are polled instead.
+func linkEvents(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("link events not supported")
+}
+
+// captureStats returns the packets received and dropped by libpcap, the drops
+// by the interface are included.
+func (ph *pcapHandler) captureStats() (uint64, uint64) {
+	stats, err := ph.handle.Stats()
+	if err != nil {
+		return 0, 0
 	}
+	return uint64(stats.PacketsReceived), uint64(stats.PacketsDropped + stats.PacketsIfDropped)
 }
 
 func (c *PcapClient) Stats() Stats {
-	return c.common.Stats()
+	stats := c.common.Stats()
+	stats.Devices = c.deviceStats()
+	return stats
 }
 
+// Close stops capturing and drains the messages captured.
 func (c *PcapClient) Close() {
-	for _, handler := range c.handlers {
-		handler.handle.Close()
+	c.cancel()
+	c.watchWg.Wait()
+	c.closeDevices()
+	if c.file != nil {
+		<-c.done
+		c.file.handle.Close()
 	}
+	c.common.Close()
 }
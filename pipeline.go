@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backpressure policies applied once a queue is full.
+const (
+	policyBlock      = "block"
+	policyDropOldest = "drop-oldest"
+	policyDropNewest = "drop-newest"
+)
+
+func checkPolicy(policy string) error {
+	switch policy {
+	case policyBlock, policyDropOldest, policyDropNewest:
+		return nil
+	}
+	return errors.Errorf("unsupported backpressure policy(%s)", policy)
+}
+
+// queue is a bounded queue with the backpressure policy, the items dropped are
+// handed to the release function.
+type queue[T any] struct {
+	ch      chan T
+	policy  string
+	release func(T)
+
+	pushed  atomic.Int64
+	dropped atomic.Int64
+}
+
+func newQueue[T any](size int, policy string, release func(T)) *queue[T] {
+	if size < 1 {
+		size = 1
+	}
+	return &queue[T]{
+		ch:      make(chan T, size),
+		policy:  policy,
+		release: release,
+	}
+}
+
+func (q *queue[T]) drop(v T) {
+	q.dropped.Add(1)
+	if q.release != nil {
+		q.release(v)
+	}
+}
+
+func (q *queue[T]) push(v T) {
+	switch q.policy {
+	case policyDropNewest:
+		select {
+		case q.ch <- v:
+		default:
+			q.drop(v)
+			return
+		}
+
+	case policyDropOldest:
+		for pushed := false; !pushed; {
+			select {
+			case q.ch <- v:
+				pushed = true
+			default:
+				select {
+				case old := <-q.ch:
+					q.drop(old)
+				default:
+				}
+			}
+		}
+
+	default:
+		q.ch <- v
+	}
+	q.pushed.Add(1)
+}
+
+func (q *queue[T]) close() {
+	close(q.ch)
+}
+
+// job is the dns message captured waiting for decoding, the payload and frame
+// are copied into the pooled buffer since the capture buffers are reused.
+type job struct {
+	sp     SP
+	device string
+	ts     time.Time
+	buf    *[]byte
+
+	// held is set once the unmatched response is held for the queries
+	// processed out of order
+	held bool
+}
+
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 2048)
+		return &b
+	},
+}
+
+func releaseJob(j *job) {
+	bufPool.Put(j.buf)
+}
+
+// PipelineStats are the counters of the pipeline stages.
+type PipelineStats struct {
+	Enqueued      int64
+	DecodeDropped int64
+	Decoded       int64
+	Formatted     int64
+	OutputDropped int64
+	Written       int64
+}
+
+type pipelineOptions struct {
+	workers      int
+	decodeQueue  int
+	decodePolicy string
+	outputQueue  int
+	outputPolicy string
+	byQuestion   bool
+	anyDevice    bool
+}
+
+func newPipelineOptions(opt Options) (pipelineOptions, error) {
+	if err := checkPolicy(opt.DecodePolicy); err != nil {
+		return pipelineOptions{}, err
+	}
+	if err := checkPolicy(opt.OutputPolicy); err != nil {
+		return pipelineOptions{}, err
+	}
+	workers := opt.Workers
+	if workers < 0 {
+		return pipelineOptions{}, errors.Errorf("invalid workers(%d)", workers)
+	}
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return pipelineOptions{
+		workers:      workers,
+		decodeQueue:  opt.DecodeQueue,
+		decodePolicy: opt.DecodePolicy,
+		outputQueue:  opt.OutputQueue,
+		outputPolicy: opt.OutputPolicy,
+		byQuestion:   opt.Correlate || opt.Collapse,
+		anyDevice:    opt.CrossDevice,
+	}, nil
+}
+
+// pipeline decouples the capture from the decoding and output. The messages
+// are sharded to the decoder workers by the device and dns id so that a query
+// and its response are processed in order by the same worker, and the results
+// are written by a single writer with buffering.
+type pipeline struct {
+	decoders   []*decoder
+	output     *queue[string]
+	process    func(*job)
+	byQuestion bool
+	anyDevice  bool
+
+	wg       sync.WaitGroup
+	outputWg sync.WaitGroup
+
+	decoded   atomic.Int64
+	formatted atomic.Int64
+	written   atomic.Int64
+
+	// mark is the capture time the decoding has reached and the wall time
+	// reaching it, last is the clock returned last time
+	clockMu sync.Mutex
+	mark    int64
+	markAt  time.Time
+	last    time.Time
+}
+
+// decoder is the decode queue of a worker, it tracks the capture time of the
+// messages decoded for the clock of the pipeline.
+type decoder struct {
+	*queue[*job]
+
+	// inflight is the number of the messages queued or in decoding
+	inflight atomic.Int64
+	// last is the capture time of the message decoded last
+	last atomic.Int64
+}
+
+func newPipeline(opt pipelineOptions, w io.Writer, process func(*job)) *pipeline {
+	p := &pipeline{
+		output:     newQueue[string](opt.outputQueue, opt.outputPolicy, nil),
+		process:    process,
+		byQuestion: opt.byQuestion,
+		anyDevice:  opt.anyDevice,
+	}
+
+	// the queue size is shared by the workers
+	size := opt.decodeQueue / opt.workers
+	for i := 0; i < opt.workers; i++ {
+		d := &decoder{}
+		d.queue = newQueue[*job](size, opt.decodePolicy, func(j *job) {
+			releaseJob(j)
+			d.inflight.Add(-1)
+		})
+		p.decoders = append(p.decoders, d)
+		p.wg.Add(1)
+		go p.decode(d)
+	}
+
+	p.outputWg.Add(1)
+	go p.write(w)
+	return p
+}
+
+// newJob copies the message into the pooled buffer.
+func newJob(sp *SP, device string, ts time.Time, withFrame bool) *job {
+	buf := bufPool.Get().(*[]byte)
+	b := append((*buf)[:0], sp.Payload...)
+	n := len(b)
+	if withFrame && sp.Frame != nil {
+		b = append(b, sp.Frame...)
+	}
+	*buf = b
+
+	j := &job{sp: *sp, device: device, ts: ts, buf: buf}
+	j.sp.Payload = b[:n:n]
+	j.sp.Frame = nil
+	if withFrame && sp.Frame != nil {
+		j.sp.Frame = b[n:]
+	}
+	return j
+}
+
+// enqueue copies the message and queues it for decoding.
+func (p *pipeline) enqueue(sp *SP, device string, ts time.Time, withFrame bool) {
+	j := newJob(sp, device, ts, withFrame)
+	d := p.decoders[p.shard(device, sp.Payload)]
+	d.inflight.Add(1)
+	d.push(j)
+}
+
+// shard hashes the message with FNV-1a, the messages are sharded by the case
+// folded question instead if correlating so that the hops of a lookup are
+// processed in order as well, and the device is left out if matching across
+// the devices.
+func (p *pipeline) shard(device string, payload []byte) int {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	h := uint32(offset32)
+	if p.byQuestion {
+		for i := 12; i < len(payload) && payload[i] != 0; i++ {
+			b := payload[i]
+			if b >= 'A' && b <= 'Z' {
+				b += 'a' - 'A'
+			}
+			h = (h ^ uint32(b)) * prime32
+		}
+		return int(h % uint32(len(p.decoders)))
+	}
+
+	if !p.anyDevice {
+		for i := 0; i < len(device); i++ {
+			h = (h ^ uint32(device[i])) * prime32
+		}
+	}
+	if len(payload) >= 2 {
+		h = (h ^ uint32(payload[0])) * prime32
+		h = (h ^ uint32(payload[1])) * prime32
+	}
+	return int(h % uint32(len(p.decoders)))
+}
+
+func (p *pipeline) decode(d *decoder) {
+	defer p.wg.Done()
+	for j := range d.ch {
+		p.process(j)
+		p.decoded.Add(1)
+		d.last.Store(j.ts.UnixNano())
+		releaseJob(j)
+		d.inflight.Add(-1)
+	}
+}
+
+// clock returns the capture time the decoding has reached, zero if nothing is
+// decoded yet. It's the oldest time of the last messages decoded by the workers
+// which have messages left so that the messages queued behind aren't expired
+// by the workers ahead, and it runs with the wall time once all the workers are
+// idle. The time never goes backwards.
+func (p *pipeline) clock() time.Time {
+	p.clockMu.Lock()
+	defer p.clockMu.Unlock()
+
+	var newest int64
+	for _, d := range p.decoders {
+		if last := d.last.Load(); last > newest {
+			newest = last
+		}
+	}
+	mark, idle := newest, true
+	for _, d := range p.decoders {
+		if d.inflight.Load() == 0 {
+			continue
+		}
+		idle = false
+		if last := d.last.Load(); last < mark {
+			mark = last
+		}
+	}
+
+	if mark > p.mark {
+		p.mark, p.markAt = mark, time.Now()
+	}
+	if p.mark == 0 {
+		return time.Time{}
+	}
+	now := time.Unix(0, p.mark)
+	if idle {
+		now = now.Add(time.Since(p.markAt))
+	}
+	if now.After(p.last) {
+		p.last = now
+	}
+	return p.last
+}
+
+// emit queues the formatted message for output.
+func (p *pipeline) emit(s string) {
+	p.formatted.Add(1)
+	p.output.push(s)
+}
+
+// write writes the messages and flushes once the queue is drained.
+func (p *pipeline) write(w io.Writer) {
+	defer p.outputWg.Done()
+	bw := bufio.NewWriterSize(w, 64*1024)
+	for s := range p.output.ch {
+		bw.WriteString(s)
+		bw.WriteByte('\n')
+		p.written.Add(1)
+		if len(p.output.ch) == 0 {
+			bw.Flush()
+		}
+	}
+	bw.Flush()
+}
+
+// closeDecoders drains the decode queues, no messages should be enqueued after
+// it.
+func (p *pipeline) closeDecoders() {
+	for _, d := range p.decoders {
+		d.close()
+	}
+	p.wg.Wait()
+}
+
+// closeOutput drains the output queue, no messages should be emitted after it.
+func (p *pipeline) closeOutput() {
+	p.output.close()
+	p.outputWg.Wait()
+}
+
+func (p *pipeline) stats() PipelineStats {
+	var stats PipelineStats
+	for _, d := range p.decoders {
+		stats.Enqueued += d.pushed.Load()
+		stats.DecodeDropped += d.dropped.Load()
+	}
+	stats.Decoded = p.decoded.Load()
+	stats.Formatted = p.formatted.Load()
+	stats.OutputDropped = p.output.dropped.Load()
+	stats.Written = p.written.Load()
+	return stats
+}
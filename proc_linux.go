@@ -0,0 +1,388 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"golang.org/x/sys/unix"
+
+	"github.com/chenjiandongx/dnstrack/formatter"
+)
+
+const (
+	procCacheSize    = 4096
+	procCacheTTL     = 10 * time.Second
+	procScanInterval = 100 * time.Millisecond
+)
+
+type sockKey struct {
+	transport string
+	ip        [net.IPv6len]byte
+	port      uint16
+}
+
+func newSockKey(transport string, ip net.IP, port uint16) sockKey {
+	key := sockKey{transport: transport, port: port}
+	copy(key.ip[:], ip.To16())
+	return key
+}
+
+type procKey struct {
+	netns uint64
+	sock  sockKey
+}
+
+// procTable maps the local sockets to their owner processes through the socket
+// tables in /proc/<pid>/net of each network namespace and the fd links in
+// /proc/<pid>/fd. The tables are loaded in batch at most once per scan interval
+// and swapped as a whole, the sockets closed before the loading are missed. The
+// misses are cached until the next loading.
+type procTable struct {
+	mu       sync.Mutex
+	sockets  *expirable.LRU[procKey, *formatter.Process]
+	misses   *expirable.LRU[procKey, struct{}]
+	snapshot atomic.Pointer[procSnapshot]
+}
+
+func newProcTable() *procTable {
+	t := &procTable{
+		sockets: expirable.NewLRU[procKey, *formatter.Process](procCacheSize, nil, procCacheTTL),
+		misses:  expirable.NewLRU[procKey, struct{}](procCacheSize, nil, procScanInterval),
+	}
+	t.snapshot.Store(&procSnapshot{})
+	return t
+}
+
+// lookup returns the process owning the local socket bound to the address, nil
+// if not found. The namespace the packet was captured in is searched first, then
+// the others since the packets of the containers are captured on the host side
+// of their veth pairs as well.
+func (t *procTable) lookup(netns uint64, transport string, addr netip.AddrPort) *formatter.Process {
+	key := procKey{netns: netns, sock: newSockKey(transport, addr.Addr().AsSlice(), addr.Port())}
+	if p, ok := t.sockets.Get(key); ok {
+		return p
+	}
+	if _, ok := t.misses.Get(key); ok {
+		return nil
+	}
+
+	s := t.snapshot.Load()
+	p := s.find(key)
+	// the addresses of the other hosts never resolve, they don't load the
+	// tables again unless the tables are stale
+	if p == nil && (s.local(key.sock.ip) || time.Since(s.loaded) >= procCacheTTL) {
+		t.reload()
+		p = t.snapshot.Load().find(key)
+	}
+	if p == nil {
+		t.misses.Add(key, struct{}{})
+		return nil
+	}
+	t.sockets.Add(key, p)
+	return p
+}
+
+// reload loads the tables again unless they were loaded within the interval,
+// the callers don't wait for the loading in progress but go on with the stale
+// tables.
+func (t *procTable) reload() {
+	if !t.mu.TryLock() {
+		return
+	}
+	defer t.mu.Unlock()
+
+	if time.Since(t.snapshot.Load().loaded) < procScanInterval {
+		return
+	}
+	t.snapshot.Store(scanProcs())
+}
+
+// procSnapshot is the sockets of the network namespaces and their owner
+// processes loaded at once.
+type procSnapshot struct {
+	netns  map[uint64]*sockTable
+	inodes map[uint64]*formatter.Process
+	loaded time.Time
+}
+
+// local tells whether the address belongs to any of the network namespaces.
+func (s *procSnapshot) local(ip [net.IPv6len]byte) bool {
+	for _, table := range s.netns {
+		if _, ok := table.local[ip]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *procSnapshot) find(key procKey) *formatter.Process {
+	if table, ok := s.netns[key.netns]; ok {
+		if inode, ok := table.find(key.sock); ok {
+			return s.inodes[inode]
+		}
+	}
+
+	// the loopback addresses are shared by all the namespaces
+	if net.IP(key.sock.ip[:]).IsLoopback() {
+		return nil
+	}
+	// the addresses could overlap across the namespaces, e.g. the isolated
+	// container networks, the ambiguous ones are left unattributed
+	var found *formatter.Process
+	for netns, table := range s.netns {
+		if netns == key.netns {
+			continue
+		}
+		if inode, ok := table.find(key.sock); ok {
+			if found != nil {
+				return nil
+			}
+			if found = s.inodes[inode]; found == nil {
+				return nil
+			}
+		}
+	}
+	return found
+}
+
+// sockTable holds the inodes of the udp and tcp sockets in a network namespace
+// and the local addresses of it.
+type sockTable struct {
+	sockets map[sockKey]uint64
+	local   map[[net.IPv6len]byte]struct{}
+}
+
+var (
+	wildcardIPv4 = net.IPv4zero.To16()
+	wildcardIPv6 = net.IPv6unspecified
+)
+
+// find finds the inode of the socket bound to the address, the ones bound to the
+// wildcard address are taken if no exact matches and the address is local since
+// the packets forwarded or sent by the other hosts aren't theirs.
+func (t *sockTable) find(key sockKey) (uint64, bool) {
+	if inode, ok := t.sockets[key]; ok {
+		return inode, true
+	}
+	if _, ok := t.local[key.ip]; !ok {
+		return 0, false
+	}
+
+	wildcards := []net.IP{wildcardIPv6}
+	// the ipv6 sockets receive the ipv4 packets as well unless IPV6_V6ONLY
+	if net.IP(key.ip[:]).To4() != nil {
+		wildcards = []net.IP{wildcardIPv4, wildcardIPv6}
+	}
+	for _, ip := range wildcards {
+		if inode, ok := t.sockets[newSockKey(key.transport, ip, key.port)]; ok {
+			return inode, true
+		}
+	}
+	return 0, false
+}
+
+// readSockTable reads the socket tables and the local addresses in the procfs
+// net directory.
+func readSockTable(dir string) *sockTable {
+	t := &sockTable{
+		sockets: make(map[sockKey]uint64),
+		local:   make(map[[net.IPv6len]byte]struct{}),
+	}
+	for _, transport := range []string{transportUDP, transportTCP} {
+		for _, name := range []string{transport, transport + "6"} {
+			readSockets(filepath.Join(dir, name), transport, t.sockets)
+		}
+	}
+	for _, ip := range localAddrs(dir) {
+		var b [net.IPv6len]byte
+		copy(b[:], ip.To16())
+		t.local[b] = struct{}{}
+	}
+	return t
+}
+
+// readSockets reads the inodes of the sockets in the table like /proc/net/udp.
+func readSockets(path, transport string, sockets map[sockKey]uint64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		ip, port, ok := parseProcAddr(fields[1])
+		if !ok {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || inode == 0 {
+			continue
+		}
+		key := newSockKey(transport, ip, port)
+		if _, ok := sockets[key]; !ok {
+			sockets[key] = inode
+		}
+	}
+}
+
+// localAddrs returns the addresses of the network namespace, the ipv4 ones are
+// the host routes of the local table in fib_trie, e.g.
+//
+//	|-- 192.168.1.10
+//	   /32 host LOCAL
+//
+// and the ipv6 ones are listed in if_inet6.
+func localAddrs(dir string) []net.IP {
+	var addrs []net.IP
+	if b, err := os.ReadFile(filepath.Join(dir, "fib_trie")); err == nil {
+		var last string
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "|-- "):
+				last = strings.TrimPrefix(line, "|-- ")
+			case strings.HasPrefix(line, "/32 host LOCAL"):
+				if ip := net.ParseIP(last); ip != nil {
+					addrs = append(addrs, ip)
+				}
+			}
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "if_inet6")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if ip, err := hex.DecodeString(fields[0]); err == nil && len(ip) == net.IPv6len {
+				addrs = append(addrs, ip)
+			}
+		}
+	}
+	return addrs
+}
+
+// parseProcAddr parses the address like 0100007F:0035, the ip is printed as
+// 32-bit words in host byte order.
+func parseProcAddr(s string) (net.IP, uint16, bool) {
+	idx := strings.IndexByte(s, ':')
+	if idx < 0 {
+		return nil, 0, false
+	}
+
+	b, err := hex.DecodeString(s[:idx])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(b); i += 4 {
+		w := uint32(b[i])<<24 | uint32(b[i+1])<<16 | uint32(b[i+2])<<8 | uint32(b[i+3])
+		*(*uint32)(unsafe.Pointer(&b[i])) = w
+	}
+
+	port, err := strconv.ParseUint(s[idx+1:], 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return net.IP(b), uint16(port), true
+}
+
+// scanProcs walks all the processes once, the socket inodes are mapped to the
+// processes holding them and the socket tables of each network namespace are
+// read through the first process in it.
+func scanProcs() *procSnapshot {
+	s := &procSnapshot{
+		netns:  make(map[uint64]*sockTable),
+		inodes: make(map[uint64]*formatter.Process),
+		loaded: time.Now(),
+	}
+	pids, err := os.ReadDir("/proc")
+	if err != nil {
+		return s
+	}
+
+	for _, entry := range pids {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		dir := filepath.Join("/proc", entry.Name())
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+
+		var p *formatter.Process
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if p == nil {
+				comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+				p = &formatter.Process{PID: pid, Comm: string(bytes.TrimSpace(comm))}
+				if cgroup, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+					setCgroup(p, parseCgroupFile(string(cgroup)))
+				}
+			}
+			s.inodes[inode] = p
+		}
+		if p == nil {
+			continue
+		}
+
+		// net:[4026531840]
+		link, err := os.Readlink(filepath.Join(dir, "ns/net"))
+		if err != nil {
+			continue
+		}
+		netns, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "net:["), "]"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.netns[netns]; !ok {
+			s.netns[netns] = readSockTable(filepath.Join(dir, "net"))
+		}
+	}
+	return s
+}
+
+// inode returns the inode of the namespace which identifies it, 0 if unknown.
+func (ns netns) inode() uint64 {
+	path := ns.path
+	if path == "" {
+		path = "/proc/self/ns/net"
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0
+	}
+	return st.Ino
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"net/netip"
+
+	"github.com/chenjiandongx/dnstrack/formatter"
+)
+
+// procTable isn't supported here since there is no procfs.
+type procTable struct{}
+
+func newProcTable() *procTable {
+	return nil
+}
+
+func (t *procTable) lookup(netns uint64, transport string, addr netip.AddrPort) *formatter.Process {
+	return nil
+}
+
+func (ns netns) inode() uint64 {
+	return 0
+}
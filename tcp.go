@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+const (
+	tcpFlushInterval = 30 * time.Second
+	tcpStreamTimeout = 2 * time.Minute
+
+	// tcpMaxFrames bounds the frames kept per stream direction, the oldest ones
+	// are dropped beyond it
+	tcpMaxFrames = 64
+)
+
+// tcpFlowKey identifies one direction of a tcp connection.
+type tcpFlowKey struct {
+	net gopacket.Flow
+	tcp gopacket.Flow
+}
+
+// tcpFrames holds the frames of the segments carrying data until the messages
+// reassembled from them are emitted, it's shared by the streams of a device.
+type tcpFrames struct {
+	device   string
+	linkType dlt
+	flows    map[tcpFlowKey][]capturedFrame
+}
+
+func (f *tcpFrames) add(k tcpFlowKey, ts time.Time, data []byte) {
+	frames := f.flows[k]
+	if len(frames) >= tcpMaxFrames {
+		frames = append(frames[:0], frames[1:]...)
+	}
+	// the buffer of the captured frame is reused by the next read
+	f.flows[k] = append(frames, capturedFrame{device: f.device, linkType: f.linkType, ts: ts, data: append([]byte(nil), data...)})
+}
+
+// take returns the frames seen so far in the direction.
+func (f *tcpFrames) take(k tcpFlowKey) []capturedFrame {
+	frames := f.flows[k]
+	delete(f.flows, k)
+	return frames
+}
+
+// tcpAssembler reassembles the dns over tcp streams captured on a device, it is
+// not safe for concurrent use hence each listener holds its own one.
+type tcpAssembler struct {
+	assembler *tcpassembly.Assembler
+	lastFlush time.Time
+	frames    *tcpFrames
+}
+
+// newTCPAssembler creates the assembler, the frames of the segments are kept for
+// the messages if the matched transactions are written to file.
+func newTCPAssembler(common *CommonClient, device string, linkType dlt, ports dnsPorts, netns uint64) *tcpAssembler {
+	var frames *tcpFrames
+	if common.w != nil && common.w.matched {
+		frames = &tcpFrames{device: device, linkType: linkType, flows: make(map[tcpFlowKey][]capturedFrame)}
+	}
+	pool := tcpassembly.NewStreamPool(&tcpStreamFactory{common: common, device: device, ports: ports, netns: netns, frames: frames})
+	assembler := tcpassembly.NewAssembler(pool)
+	assembler.MaxBufferedPagesTotal = 4096
+	assembler.MaxBufferedPagesPerConnection = 64
+	return &tcpAssembler{assembler: assembler, frames: frames}
+}
+
+func (a *tcpAssembler) assemble(netFlow gopacket.Flow, tcp *layers.TCP, ts time.Time, frame []byte) {
+	if a.frames != nil && len(tcp.Payload) > 0 {
+		a.frames.add(tcpFlowKey{net: netFlow, tcp: tcp.TransportFlow()}, ts, frame)
+	}
+	a.assembler.AssembleWithTimestamp(netFlow, tcp, ts)
+	if a.lastFlush.IsZero() {
+		a.lastFlush = ts
+	}
+	if ts.Sub(a.lastFlush) >= tcpFlushInterval {
+		a.assembler.FlushOlderThan(ts.Add(-tcpStreamTimeout))
+		a.lastFlush = ts
+	}
+}
+
+type tcpStreamFactory struct {
+	common *CommonClient
+	device string
+	ports  dnsPorts
+	netns  uint64
+	frames *tcpFrames
+}
+
+func (f *tcpStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	srcPort := binary.BigEndian.Uint16(tcpFlow.Src().Raw())
+	dstPort := binary.BigEndian.Uint16(tcpFlow.Dst().Raw())
+	srcIP, dstIP := net.IP(netFlow.Src().Raw()), net.IP(netFlow.Dst().Raw())
+	server, _ := f.ports.serverAddr(srcIP, dstIP, srcPort, dstPort)
+
+	s := &tcpStream{
+		common: f.common,
+		device: f.device,
+		server: server,
+		src:    addrPort(srcIP, srcPort),
+		dst:    addrPort(dstIP, dstPort),
+		netns:  f.netns,
+		key:    tcpFlowKey{net: netFlow, tcp: tcpFlow},
+		frames: f.frames,
+	}
+	return s
+}
+
+// tcpStream splits one direction of a tcp connection into dns messages, each of
+// them is prefixed with a two byte length field as described in RFC 1035 4.2.2.
+type tcpStream struct {
+	common *CommonClient
+	device string
+	server string
+	src    netip.AddrPort
+	dst    netip.AddrPort
+	netns  uint64
+	key    tcpFlowKey
+	frames *tcpFrames
+	buf    []byte
+	broken bool
+}
+
+func (s *tcpStream) Reassembled(rs []tcpassembly.Reassembly) {
+	for _, r := range rs {
+		if s.broken {
+			return
+		}
+
+		// message boundaries are lost once any bytes are missing
+		if r.Skip != 0 {
+			s.broken = true
+			s.buf = nil
+			return
+		}
+
+		s.buf = append(s.buf, r.Bytes...)
+		var offset int
+		for len(s.buf)-offset >= 2 {
+			n := int(binary.BigEndian.Uint16(s.buf[offset:]))
+			if len(s.buf)-offset-2 < n {
+				break
+			}
+			sp := &SP{
+				Server:    s.server,
+				Transport: transportTCP,
+				Payload:   s.buf[offset+2 : offset+2+n],
+				Src:       s.src,
+				Dst:       s.dst,
+				Netns:     s.netns,
+			}
+			if s.frames != nil {
+				sp.Segments = s.frames.take(s.key)
+			}
+			s.common.Display(sp, s.device, r.Seen)
+			offset += 2 + n
+		}
+		s.buf = append(s.buf[:0], s.buf[offset:]...)
+	}
+}
+
+func (s *tcpStream) ReassemblyComplete() {
+	s.buf = nil
+	if s.frames != nil {
+		s.frames.take(s.key)
+	}
+}
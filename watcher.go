@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// attachedDevice holds the handlers opened on a device, they are detached
+// together once the device disappears.
+type attachedDevice struct {
+	index    int
+	handlers []*pcapHandler
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// stats sums up the capture counters of the handlers.
+func (d *attachedDevice) stats() (uint64, uint64) {
+	var received, dropped uint64
+	for _, handler := range d.handlers {
+		r, dr := handler.captureStats()
+		received += r
+		dropped += dr
+	}
+	return received, dropped
+}
+
+// close stops the listeners and waits for them before closing the handlers so
+// that no one reads from the closed ones. The final capture counters are
+// returned.
+func (d *attachedDevice) close() (uint64, uint64) {
+	d.cancel()
+	d.wg.Wait()
+	received, dropped := d.stats()
+	for _, handler := range d.handlers {
+		handler.close()
+	}
+	return received, dropped
+}
+
+func (c *PcapClient) getAvailableDevices() error {
+	for _, ns := range c.netns {
+		devs, err := c.listDevices(ns)
+		if err != nil {
+			c.closeDevices()
+			return err
+		}
+
+		for _, device := range devs {
+			if err := c.attach(device); err != nil {
+				c.closeDevices()
+				return err
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.devices) == 0 {
+		return errors.New("no available devices found")
+	}
+	return nil
+}
+
+// attach opens the device in the namespace and starts listening on it, the
+// devices which can't be captured are remembered to be skipped by the next sync
+// unless recreated.
+func (c *PcapClient) attach(nd nsDevice) error {
+	ns := nd.ns
+	device := ns.device(nd.name)
+	handlers, err := c.openDevice(ns, nd.name)
+	if err != nil || len(handlers) == 0 {
+		c.mu.Lock()
+		c.skipped[device] = nd.index
+		c.mu.Unlock()
+		return err
+	}
+
+	inode := ns.inode()
+	ctx, cancel := context.WithCancel(c.ctx)
+	d := &attachedDevice{index: nd.index, handlers: handlers, cancel: cancel}
+	for _, handler := range handlers {
+		handler.parser = newParser(c.common, handler.device, handler.linkType, c.ports, c.opt.Multicast, inode)
+		d.wg.Add(1)
+		go func(handler *pcapHandler) {
+			defer d.wg.Done()
+			c.listen(ctx, handler)
+		}(handler)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the client is closed during the opening
+	if c.ctx.Err() != nil {
+		d.close()
+		return nil
+	}
+	c.devices[device] = d
+	c.updateIfaceWidth()
+	return nil
+}
+
+func (c *PcapClient) detach(device string) {
+	c.mu.Lock()
+	d, ok := c.devices[device]
+	delete(c.devices, device)
+	c.updateIfaceWidth()
+	c.mu.Unlock()
+
+	if ok {
+		c.closeDevice(device, d)
+	}
+}
+
+// closeDevice closes the detached device, the counters are kept for the summary.
+func (c *PcapClient) closeDevice(device string, d *attachedDevice) {
+	received, dropped := d.close()
+
+	c.mu.Lock()
+	stats := c.detached[device]
+	stats.Received += received
+	stats.Dropped += dropped
+	c.detached[device] = stats
+	c.mu.Unlock()
+}
+
+// deviceStats returns the capture counters of the attached and detached devices.
+func (c *PcapClient) deviceStats() []DeviceStats {
+	c.mu.Lock()
+	devices := make(map[string]*attachedDevice, len(c.devices))
+	for device, d := range c.devices {
+		devices[device] = d
+	}
+	all := make(map[string]DeviceStats, len(c.devices)+len(c.detached))
+	for device, stats := range c.detached {
+		all[device] = stats
+	}
+	c.mu.Unlock()
+
+	for device, d := range devices {
+		received, dropped := d.stats()
+		stats := all[device]
+		stats.Received += received
+		stats.Dropped += dropped
+		all[device] = stats
+	}
+
+	r := make([]DeviceStats, 0, len(all))
+	for device, stats := range all {
+		stats.Device = device
+		r = append(r, stats)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Device < r[j].Device
+	})
+	return r
+}
+
+// updateIfaceWidth resets the device column width of the question formatter to
+// the longest attached device name, c.mu must be held.
+func (c *PcapClient) updateIfaceWidth() {
+	var n int
+	for device := range c.devices {
+		if len(device) > n {
+			n = len(device)
+		}
+	}
+	c.ifaceWidth.Store(int64(n))
+}
+
+// syncDevices attaches the matched devices appeared since the last sync and
+// detaches the ones gone, all devices of a vanished namespace are gone as well.
+// The devices recreated with the same name, e.g. the veth pairs, are attached
+// again since the handlers on the deleted ones are dead.
+func (c *PcapClient) syncDevices() {
+	present := make(map[string]nsDevice)
+	for _, ns := range c.netns {
+		devs, err := c.listDevices(ns)
+		if err != nil {
+			continue
+		}
+		for _, device := range devs {
+			present[ns.device(device.name)] = device
+		}
+	}
+
+	c.mu.Lock()
+	var added []nsDevice
+	var removed []string
+	for device, d := range present {
+		if attached, ok := c.devices[device]; ok {
+			if attached.index == d.index {
+				continue
+			}
+			removed = append(removed, device)
+		} else if index, ok := c.skipped[device]; ok {
+			if index == d.index {
+				continue
+			}
+			delete(c.skipped, device)
+		}
+		added = append(added, d)
+	}
+	for device := range c.devices {
+		if _, ok := present[device]; !ok {
+			removed = append(removed, device)
+		}
+	}
+	for device := range c.skipped {
+		if _, ok := present[device]; !ok {
+			delete(c.skipped, device)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, device := range removed {
+		c.detach(device)
+	}
+	for _, d := range added {
+		if err := c.attach(d); err != nil {
+			fmt.Fprintln(os.Stderr, "Attach device failed:", err.Error())
+		}
+	}
+}
+
+func (c *PcapClient) startWatcher() {
+	c.watchWg.Add(1)
+	go func() {
+		defer c.watchWg.Done()
+		c.watchDevices()
+	}()
+}
+
+// watchDevices keeps the attached devices in sync with the matched ones, the
+// devices are rescanned on link events of any namespace or polled once the
+// events are unavailable in any of them.
+func (c *PcapClient) watchDevices() {
+	events := make(chan struct{}, 1)
+	lost := make(chan struct{})
+	var once sync.Once
+	for _, ns := range c.netns {
+		var ch <-chan struct{}
+		err := inNetns(ns, func() error {
+			var err error
+			ch, err = linkEvents(c.ctx)
+			return err
+		})
+		if err != nil {
+			once.Do(func() { close(lost) })
+			break
+		}
+
+		go func() {
+			for range ch {
+				select {
+				case events <- struct{}{}:
+				default:
+				}
+			}
+			once.Do(func() { close(lost) })
+		}()
+	}
+
+	ticker := time.NewTicker(c.opt.WatchInterval)
+	defer ticker.Stop()
+
+	var polling bool
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+
+		case <-lost:
+			polling, lost = true, nil
+
+		case <-events:
+			c.syncDevices()
+
+		case <-ticker.C:
+			if polling {
+				c.syncDevices()
+			}
+		}
+	}
+}
+
+func (c *PcapClient) closeDevices() {
+	c.mu.Lock()
+	devices := c.devices
+	c.devices = make(map[string]*attachedDevice)
+	c.mu.Unlock()
+
+	for device, d := range devices {
+		c.closeDevice(device, d)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pkg/errors"
+)
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// capturedFrame is the frame kept until its transaction is known to pass the
+// filters.
+type capturedFrame struct {
+	device   string
+	linkType dlt
+	ts       time.Time
+	data     []byte
+}
+
+// pcapWriter writes the captured frames into pcap or pcapng files, the format is
+// decided by the file extension. Files are rotated by size and time if required.
+type pcapWriter struct {
+	mu       sync.Mutex
+	path     string
+	ng       bool
+	matched  bool
+	maxSize  int64
+	interval time.Duration
+
+	seq      int
+	f        *os.File
+	cw       *countWriter
+	opened   time.Time
+	w        *pcapgo.Writer
+	ngw      *pcapgo.NgWriter
+	linkType dlt
+	ifaces   map[string]int
+	closed   bool
+	err      error
+}
+
+func newPcapWriter(opt Options) *pcapWriter {
+	if opt.Write == "" {
+		return nil
+	}
+
+	return &pcapWriter{
+		path:     opt.Write,
+		ng:       strings.EqualFold(filepath.Ext(opt.Write), ".pcapng"),
+		matched:  opt.WriteMatched,
+		maxSize:  int64(opt.WriteSize) * 1024 * 1024,
+		interval: opt.WriteInterval,
+	}
+}
+
+// Write writes the frame captured on the device, writing stops after the first
+// failure which is reported to stderr.
+func (w *pcapWriter) Write(device string, linkType dlt, ts time.Time, data []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.err != nil {
+		return
+	}
+	if err := w.write(device, linkType, ts, data); err != nil {
+		w.err = err
+		fmt.Fprintln(os.Stderr, "Write packets failed:", err.Error())
+	}
+}
+
+func (w *pcapWriter) write(device string, linkType dlt, ts time.Time, data []byte) error {
+	if _, ok := linkType.layersType(); !ok {
+		return errors.Errorf("link type(%s) of device(%s) can't be written", linkType, device)
+	}
+	if w.f != nil && w.shouldRotate(ts) {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	if w.f == nil {
+		if err := w.open(device, linkType, ts); err != nil {
+			return err
+		}
+	}
+
+	ci := gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+
+	if w.ngw == nil {
+		// classic pcap file holds frames of a single link type
+		if linkType != w.linkType {
+			return errors.Errorf("link type(%s) of device(%s) differs from the one(%s) of file(%s), write to pcapng instead", linkType, device, w.linkType, w.f.Name())
+		}
+		return w.w.WritePacket(ci, data)
+	}
+
+	idx, ok := w.ifaces[device]
+	if !ok {
+		var err error
+		if idx, err = w.ngw.AddInterface(ngInterface(device, linkType)); err != nil {
+			return err
+		}
+		w.ifaces[device] = idx
+	}
+	ci.InterfaceIndex = idx
+	return w.ngw.WritePacket(ci, data)
+}
+
+func (w *pcapWriter) shouldRotate(ts time.Time) bool {
+	if w.maxSize > 0 && w.cw.n >= w.maxSize {
+		return true
+	}
+	return w.interval > 0 && ts.Sub(w.opened) >= w.interval
+}
+
+func (w *pcapWriter) filename() string {
+	if w.maxSize <= 0 && w.interval <= 0 {
+		return w.path
+	}
+
+	ext := filepath.Ext(w.path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(w.path, ext), w.seq, ext)
+}
+
+func (w *pcapWriter) open(device string, linkType dlt, ts time.Time) error {
+	name := w.filename()
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.Wrapf(err, "create file(%s) failed", name)
+	}
+
+	w.seq++
+	w.f = f
+	w.cw = &countWriter{w: f}
+	w.opened = ts
+
+	if w.ng {
+		w.ngw, err = pcapgo.NewNgWriterInterface(w.cw, ngInterface(device, linkType), pcapgo.DefaultNgWriterOptions)
+		w.ifaces = map[string]int{device: 0}
+		return err
+	}
+
+	// the link type of the first file is kept for the rotated ones
+	if w.seq == 1 {
+		w.linkType = linkType
+	}
+	w.w = pcapgo.NewWriterNanos(w.cw)
+	lt, _ := w.linkType.layersType()
+	return w.w.WriteFileHeader(65535, lt)
+}
+
+func (w *pcapWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+
+	var err error
+	if w.ngw != nil {
+		err = w.ngw.Flush()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f, w.w, w.ngw = nil, nil, nil
+	return err
+}
+
+func (w *pcapWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if err := w.close(); err != nil && w.err == nil {
+		fmt.Fprintln(os.Stderr, "Close written file failed:", err.Error())
+	}
+}
+
+func ngInterface(device string, linkType dlt) pcapgo.NgInterface {
+	lt, _ := linkType.layersType()
+	return pcapgo.NgInterface{
+		Name:                device,
+		OS:                  runtime.GOOS,
+		LinkType:            lt,
+		TimestampResolution: 9,
+	}
+}